@@ -1,78 +1,877 @@
 package mpsclient
 
 import (
-	"fmt"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+
 	"github.com/moodbase/TxForesight/mps"
-	"net/url"
-	"time"
 )
 
+var (
+	ErrClosed   = errors.New("mps client closed")
+	ErrConnLost = errors.New("mps conn lost before the response")
+	ErrRejected = errors.New("mps request rejected")
+	// ErrNotConnected is returned by the requests sent before the first conn of WithBackgroundDial
+	ErrNotConnected = errors.New("mps not connected yet")
+)
+
+// responseHandler receives the response of a request, or the error which prevents it
+type responseHandler func(resp *mps.ResponsePacket, err error)
+
+// ConnState describes the state of the connection to the MPS server
+type ConnState int
+
+const (
+	StateConnected ConnState = iota
+	StateReconnecting
+	StateGaveUp
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateGaveUp:
+		return "gave up"
+	default:
+		return "unknown"
+	}
+}
+
+// Backoff controls how the client waits between reconnect attempts.
+// The delay starts at Initial and is multiplied by Multiplier after every
+// failed attempt, capped at Max. MaxRetries of 0 retries forever.
+type Backoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	MaxRetries int
+}
+
+var DefaultBackoff = Backoff{
+	Initial:    time.Second,
+	Max:        30 * time.Second,
+	Multiplier: 2,
+}
+
+func (b Backoff) next(delay time.Duration) time.Duration {
+	delay = time.Duration(float64(delay) * b.Multiplier)
+	if delay > b.Max {
+		delay = b.Max
+	}
+	return delay
+}
+
+// StateHandler is called on every connection state change,
+// err is the cause of the last disconnection or failed attempt, if any
+type StateHandler func(state ConnState, err error)
+
+type Option func(c *Client) error
+
+// WithBackoff overrides DefaultBackoff
+func WithBackoff(b Backoff) Option {
+	return func(c *Client) error {
+		if b.Initial <= 0 || b.Max < b.Initial || b.Multiplier < 1 {
+			return errors.Errorf("invalid backoff %+v", b)
+		}
+		c.backoff = b
+		return nil
+	}
+}
+
+// WithStateHandler registers fn to be notified of connection state changes
+func WithStateHandler(fn StateHandler) Option {
+	return func(c *Client) error {
+		c.onState = fn
+		return nil
+	}
+}
+
+// WithBearerToken authenticates with a static token of the MPS server
+func WithBearerToken(token string) Option {
+	return func(c *Client) error {
+		c.auth = func() (string, error) {
+			return token, nil
+		}
+		return nil
+	}
+}
+
+// WithJWTSecret authenticates with a HS256 JWT signed by the 32 bytes secret
+// shared with the MPS server, a fresh token is issued for every dial
+func WithJWTSecret(secret []byte) Option {
+	return func(c *Client) error {
+		if len(secret) != 32 {
+			return errors.Errorf("invalid jwt secret length %d, want 32", len(secret))
+		}
+		c.auth = func() (string, error) {
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+				"iat": &jwt.NumericDate{Time: time.Now()},
+			})
+			return token.SignedString(secret)
+		}
+		return nil
+	}
+}
+
+// WithTLSConfig dials wss:// with cfg, which carries the root CAs and client certificate if any
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(c *Client) error {
+		c.tlsConfig = cfg
+		return nil
+	}
+}
+
+// WithCABundle dials wss:// and trusts the PEM certificates of the file at path
+// in addition to the root CAs of WithTLSConfig, or the system ones, whatever the order of the options
+func WithCABundle(path string) Option {
+	return func(c *Client) error {
+		c.caBundles = append(c.caBundles, path)
+		return nil
+	}
+}
+
+// buildTLSConfig adds the CA bundles to the root CAs of the tls config, once all options are applied
+func (c *Client) buildTLSConfig() error {
+	if len(c.caBundles) == 0 {
+		return nil
+	}
+	var pool *x509.CertPool
+	if c.tlsConfig == nil {
+		c.tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	} else {
+		c.tlsConfig = c.tlsConfig.Clone()
+		if c.tlsConfig.RootCAs != nil {
+			pool = c.tlsConfig.RootCAs.Clone()
+		}
+	}
+	if pool == nil {
+		var err error
+		if pool, err = x509.SystemCertPool(); err != nil {
+			pool = x509.NewCertPool()
+		}
+	}
+	for _, path := range c.caBundles {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.Errorf("no certificate found in %s", path)
+		}
+	}
+	c.tlsConfig.RootCAs = pool
+	return nil
+}
+
+// WithEncoding asks the server for enc, DefaultEncoding is asked otherwise.
+// Servers which don't support it fall back to mps.EncodingJSON. The payloads of other
+// encodings than JSON must be read with mps.FeedPacket.Decode, see DrainLoop.
+func WithEncoding(enc mps.Encoding) Option {
+	return func(c *Client) error {
+		if !slices.Contains(mps.SupportEncodings, enc) {
+			return errors.Errorf("unsupported encoding %q", enc)
+		}
+		c.encoding = enc
+		return nil
+	}
+}
+
+// Keepalive controls the pings sent to the server, the conn is considered dead and
+// reconnected when nothing, pong or packet, is received within Timeout after a ping
+type Keepalive struct {
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+var DefaultKeepalive = Keepalive{
+	Interval: 30 * time.Second,
+	Timeout:  10 * time.Second,
+}
+
+// WithKeepalive overrides DefaultKeepalive
+func WithKeepalive(k Keepalive) Option {
+	return func(c *Client) error {
+		if k.Interval <= 0 || k.Timeout <= 0 {
+			return errors.Errorf("invalid keepalive %+v", k)
+		}
+		c.keepalive = k
+		return nil
+	}
+}
+
+// WithBackgroundDial lets New return when the server can't be dialed, the dial is then
+// retried in the background like a reconnect. The subscriptions made meanwhile are sent once connected.
+func WithBackgroundDial() Option {
+	return func(c *Client) error {
+		c.backgroundDial = true
+		return nil
+	}
+}
+
+// DefaultEncoding keeps the payloads of the packets relayed by DrainLoop in JSON,
+// mps.EncodingRLP roughly halves the bandwidth but needs mps.FeedPacket.Decode, see WithEncoding
+const DefaultEncoding = mps.EncodingJSON
+
+type subscription struct {
+	topic  mps.Topic
+	filter *mps.TxFilter
+}
+
 type Client struct {
-	conn *websocket.Conn
+	url string
+
+	conn      *websocket.Conn
+	hello     *mps.Hello // hello of the server behind conn
+	connLock  sync.RWMutex
+	writeLock sync.Mutex
+
+	lastID      atomic.Int64
+	pending     map[int]responseHandler // requests waiting for their response, by id
+	pendingLock sync.Mutex
+
+	// topics requested by the caller, replayed in order after reconnecting
+	topics     []subscription
+	topicsLock sync.Mutex
+	// last packet received per sequenced topic, to resume from after reconnecting
+	lastSeq map[mps.Topic]resumePoint
+	seqLock sync.Mutex
+
+	backoff   Backoff
+	keepalive Keepalive
+	onState   StateHandler
+	auth      func() (token string, err error)
+
+	tlsConfig *tls.Config
+	caBundles []string // added to the root CAs of tlsConfig
+	encoding  mps.Encoding
+	dialer    *websocket.Dialer
+
+	backgroundDial bool
+
+	packets   chan *mps.FeedPacket
+	err       error // why readLoop gave up reconnecting, set before packets is closed
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+// New connects to the MPS server at addr, which is either host:port,
+// or a full ws:// or wss:// url when the server is not served at the default path.
+// A host:port addr is dialed with wss:// if any tls option is given.
+func New(addr string, opts ...Option) (*Client, error) {
+	c := &Client{
+		backoff:   DefaultBackoff,
+		keepalive: DefaultKeepalive,
+		encoding:  DefaultEncoding,
+		lastSeq:   make(map[mps.Topic]resumePoint),
+		pending:   make(map[int]responseHandler),
+		packets:   make(chan *mps.FeedPacket, 64),
+		closeCh:   make(chan struct{}),
+	}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.buildTLSConfig(); err != nil {
+		return nil, err
+	}
+	u := &url.URL{Scheme: "ws", Host: addr, Path: "/"}
+	if c.tlsConfig != nil {
+		u.Scheme = "wss"
+	}
+	if strings.Contains(addr, "://") {
+		var err error
+		if u, err = url.Parse(addr); err != nil {
+			return nil, err
+		}
+	}
+	c.url = u.String()
+	c.dialer = &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: websocket.DefaultDialer.HandshakeTimeout,
+		TLSClientConfig:  c.tlsConfig,
+		Subprotocols:     []string{string(c.encoding)},
+	}
+	conn, hello, err := c.dial()
+	if err != nil {
+		// the server won't become compatible by retrying
+		if !c.backgroundDial || errors.Is(err, mps.ErrIncompatibleProtocol) {
+			return nil, err
+		}
+		log.Warn("mps dial failed, retrying in the background", "url", c.url, "err", err)
+		go c.readLoop(err)
+		return c, nil
+	}
+	c.conn, c.hello = conn, hello
+	c.notify(StateConnected, nil)
+	go c.pingLoop(conn)
+	go c.readLoop(nil)
+	return c, nil
+}
+
+// dial connects and handshakes with the server, returning the server hello
+func (c *Client) dial() (*websocket.Conn, *mps.Hello, error) {
+	header := make(http.Header)
+	if c.auth != nil {
+		token, err := c.auth()
+		if err != nil {
+			return nil, nil, err
+		}
+		header.Set("Authorization", "Bearer "+token)
+	}
+	conn, resp, err := c.dialer.Dial(c.url, header)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return nil, nil, errors.Wrap(err, "mps authentication failed")
+		}
+		return nil, nil, err
+	}
+	hello, err := c.handshake(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetPongHandler(func(string) error {
+		c.extendReadDeadline(conn)
+		return nil
+	})
+	return conn, hello, nil
+}
+
+// extendReadDeadline expects a pong or a packet within one keepalive interval and timeout
+func (c *Client) extendReadDeadline(conn *websocket.Conn) {
+	conn.SetReadDeadline(time.Now().Add(c.keepalive.Interval + c.keepalive.Timeout))
+}
+
+// pingLoop pings the server every keepalive interval until conn is replaced or closed
+func (c *Client) pingLoop(conn *websocket.Conn) {
+	ticker := time.NewTicker(c.keepalive.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.closeCh:
+			return
+		}
+		if c.getConn() != conn {
+			return
+		}
+		if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.keepalive.Timeout)); err != nil {
+			// the read deadline notices the dead conn
+			log.Debug("mps ping failed", "url", c.url, "err", err)
+			return
+		}
+	}
+}
+
+// handshake checks the protocol version of the server hello and replies with the client hello,
+// the error wraps mps.ErrIncompatibleProtocol if the server can't be spoken to
+func (c *Client) handshake(conn *websocket.Conn) (*mps.Hello, error) {
+	conn.SetReadDeadline(time.Now().Add(c.dialer.HandshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	packet, err := readPacket(conn)
+	if err != nil {
+		return nil, errors.Wrap(err, "read server hello")
+	}
+	if packet.Type != mps.FeedTypeHello {
+		return nil, errors.Wrapf(mps.ErrIncompatibleProtocol, "server sent packet type %d instead of hello, it predates protocol version 1", packet.Type)
+	}
+	var server mps.Hello
+	if err := packet.Decode(&server); err != nil {
+		return nil, errors.Wrap(err, "decode server hello")
+	}
+	local := mps.NewHello()
+	local.Encodings = []mps.Encoding{c.encoding}
+	version, err := local.Negotiate(&server)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.WriteJSON(mps.RequestPacket{Id: c.nextID(), Op: mps.ClientOptHello, Hello: local})
+	if err != nil {
+		return nil, err
+	}
+	if packet, err = readPacket(conn); err != nil {
+		return nil, errors.Wrap(err, "read hello response")
+	}
+	var resp mps.ResponsePacket
+	if packet.Type != mps.FeedTypeResponse {
+		return nil, errors.Errorf("unexpected packet type %d in handshake", packet.Type)
+	}
+	if err := packet.Decode(&resp); err != nil {
+		return nil, err
+	}
+	if !resp.Ok {
+		return nil, errors.Wrap(mps.ErrIncompatibleProtocol, resp.Message)
+	}
+	log.Debug("mps handshake done", "url", c.url, "version", version, "encoding", conn.Subprotocol())
+	return &server, nil
 }
 
-func New(addr string) (*Client, error) {
-	u := url.URL{Scheme: "ws", Host: addr, Path: "/"}
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+func readPacket(conn *websocket.Conn) (*mps.FeedPacket, error) {
+	messageType, data, err := conn.ReadMessage()
 	if err != nil {
 		return nil, err
 	}
-	return &Client{conn}, nil
+	return mps.DecodePacket(messageType, data)
+}
+
+// ServerHello returns the hello of the server currently connected, which advertises
+// its protocol version, topics, encodings and features, nil until connected with WithBackgroundDial
+func (c *Client) ServerHello() *mps.Hello {
+	c.connLock.RLock()
+	defer c.connLock.RUnlock()
+	return c.hello
+}
+
+func (c *Client) notify(state ConnState, err error) {
+	if c.onState != nil {
+		c.onState(state, err)
+	}
+}
+
+func (c *Client) closed() bool {
+	select {
+	case <-c.closeCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Client) getConn() *websocket.Conn {
+	c.connLock.RLock()
+	defer c.connLock.RUnlock()
+	return c.conn
+}
+
+// setConn replaces the current conn, it refuses to do so once the client is closed
+func (c *Client) setConn(conn *websocket.Conn, hello *mps.Hello) error {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+	if c.closed() {
+		conn.Close()
+		return ErrClosed
+	}
+	c.conn, c.hello = conn, hello
+	return nil
 }
 
 func (c *Client) Close() {
-	c.conn.Close()
+	c.closeOnce.Do(func() {
+		close(c.closeCh)
+		c.connLock.RLock()
+		if c.conn != nil {
+			c.conn.Close()
+		}
+		c.connLock.RUnlock()
+	})
 }
 
-// DrainLoop relay packets from conn
+// DrainLoop relay packets from conn, it returns once the client is closed
+// or gave up reconnecting. Their payloads are in the encoding of the client, to be
+// read with mps.FeedPacket.Decode unless it's DefaultEncoding. Stream decodes them instead.
 func (c *Client) DrainLoop(ch chan<- *mps.FeedPacket) {
+	for packet := range c.packets {
+		select {
+		case ch <- packet:
+		case <-c.closeCh:
+			return
+		}
+	}
+}
+
+// readLoop reads packets until the client is closed, reconnecting whenever the conn drops.
+// dialErr is the error of the first dial if it failed, which is then retried first.
+func (c *Client) readLoop(dialErr error) {
+	defer close(c.packets)
+	if dialErr != nil {
+		if err := c.reconnect(dialErr); err != nil {
+			c.err = err
+			return
+		}
+	}
 	for {
-		var packet mps.FeedPacket
-		err := c.conn.ReadJSON(&packet)
+		conn := c.getConn()
+		c.extendReadDeadline(conn)
+		messageType, data, err := conn.ReadMessage()
 		if err != nil {
-			if !websocket.IsCloseError(err) {
-				fmt.Println(err)
-			} else {
-				fmt.Println("conn close")
-				c.conn.Close()
+			if c.closed() {
+				return
+			}
+			log.Warn("mps conn lost", "url", c.url, "err", err)
+			if err := c.reconnect(err); err != nil {
+				c.err = err
+				return
 			}
+			continue
+		}
+		// decoded in the encoding negotiated with the server
+		packet, err := mps.DecodePacket(messageType, data)
+		if err != nil {
+			log.Warn("invalid mps packet", "url", c.url, "err", err)
+			continue
+		}
+		if packet.Type == mps.FeedTypeResponse {
+			var resp mps.ResponsePacket
+			if err := packet.Decode(&resp); err == nil && c.handleResponse(&resp) {
+				continue
+			}
+		}
+		if topic, ok := packet.Type.Topic(); ok && packet.Seq > 0 {
+			if gap := c.track(topic, packet); gap != nil {
+				select {
+				case c.packets <- gap:
+				case <-c.closeCh:
+					return
+				}
+			}
+		}
+		select {
+		case c.packets <- packet:
+		case <-c.closeCh:
 			return
 		}
-		ch <- &packet
 	}
 }
 
-func (c *Client) subscribeTopic(t mps.Topic) {
-	req := mps.RequestPacket{
-		Op:    mps.ClientOptSubscribe,
-		Id:    int(time.Now().Unix()),
-		Topic: t,
+// resumePoint is the seq of the last packet received on a topic, within the epoch of its server
+type resumePoint struct {
+	epoch string
+	seq   uint64
+}
+
+// track records packet as the last one received on topic, and returns a gap packet
+// if the packets between the previous one received and packet were lost
+func (c *Client) track(topic mps.Topic, packet *mps.FeedPacket) *mps.FeedPacket {
+	epoch := c.ServerHello().Epoch
+	c.seqLock.Lock()
+	last, ok := c.lastSeq[topic]
+	c.lastSeq[topic] = resumePoint{epoch: epoch, seq: packet.Seq}
+	c.seqLock.Unlock()
+	if !ok || last.epoch != epoch || packet.Prev == 0 || packet.Prev == last.seq {
+		return nil
+	}
+	log.Warn("mps packets lost", "url", c.url, "topic", topic, "last", last.seq, "prev", packet.Prev, "seq", packet.Seq)
+	data, _ := json.Marshal(mps.GapPacket{Topic: topic, ResumeFrom: last.seq, Oldest: packet.Seq, Latest: packet.Seq})
+	return &mps.FeedPacket{Type: mps.FeedTypeGap, Data: data}
+}
+
+// reconnect dials with exponential backoff until it succeeds, the client is closed
+// or the retry limit is reached, subscribed topics are replayed on the new conn
+func (c *Client) reconnect(cause error) error {
+	if conn := c.getConn(); conn != nil {
+		conn.Close()
+	}
+	c.failPending(ErrConnLost)
+	delay := c.backoff.Initial
+	for attempt := 1; ; attempt++ {
+		c.notify(StateReconnecting, cause)
+		select {
+		case <-time.After(delay):
+		case <-c.closeCh:
+			return ErrClosed
+		}
+		conn, hello, err := c.dial()
+		if err == nil {
+			if err = c.setConn(conn, hello); err != nil {
+				return err
+			}
+			go c.pingLoop(conn)
+			if err = c.resubscribe(); err == nil {
+				log.Info("mps conn recovered", "url", c.url, "attempt", attempt)
+				c.notify(StateConnected, nil)
+				return nil
+			}
+			conn.Close()
+		}
+		log.Warn("mps reconnect failed", "url", c.url, "attempt", attempt, "err", err)
+		cause = err
+		// the server won't become compatible by retrying
+		if errors.Is(err, mps.ErrIncompatibleProtocol) || c.backoff.MaxRetries > 0 && attempt >= c.backoff.MaxRetries {
+			c.notify(StateGaveUp, cause)
+			return err
+		}
+		delay = c.backoff.next(delay)
+	}
+}
+
+// resubscribe replays the subscriptions, resuming the sequenced topics
+// right after the last packet received
+func (c *Client) resubscribe() error {
+	c.topicsLock.Lock()
+	defer c.topicsLock.Unlock()
+	for _, sub := range c.topics {
+		req := mps.RequestPacket{
+			Op:     mps.ClientOptSubscribe,
+			Topic:  sub.topic,
+			Filter: sub.filter,
+		}
+		c.seqLock.Lock()
+		if last, ok := c.lastSeq[sub.topic]; ok {
+			req.ResumeFrom, req.Epoch = &last.seq, last.epoch
+		}
+		c.seqLock.Unlock()
+		topic := sub.topic
+		err := c.request(req, func(resp *mps.ResponsePacket, err error) {
+			if err == nil && !resp.Ok {
+				log.Error("mps resubscription rejected", "url", c.url, "topic", topic, "msg", resp.Message)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nextID returns a request id unique to the client
+func (c *Client) nextID() int {
+	return int(c.lastID.Add(1))
+}
+
+// request sends req with a fresh id, cb is called with the server response,
+// or with ErrConnLost if the conn drops before the response is received
+func (c *Client) request(req mps.RequestPacket, cb responseHandler) error {
+	req.Id = c.nextID()
+	c.pendingLock.Lock()
+	c.pending[req.Id] = cb
+	c.pendingLock.Unlock()
+	if err := c.writeRequest(req); err != nil {
+		c.pendingLock.Lock()
+		delete(c.pending, req.Id)
+		c.pendingLock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// handleResponse routes resp to its pending request, ok is false if no request is waiting for it
+func (c *Client) handleResponse(resp *mps.ResponsePacket) (ok bool) {
+	c.pendingLock.Lock()
+	cb, ok := c.pending[resp.Id]
+	delete(c.pending, resp.Id)
+	c.pendingLock.Unlock()
+	if ok {
+		cb(resp, nil)
+	}
+	return ok
+}
+
+// failPending fails every pending request, their responses won't come on a new conn
+func (c *Client) failPending(err error) {
+	c.pendingLock.Lock()
+	pending := c.pending
+	c.pending = make(map[int]responseHandler)
+	c.pendingLock.Unlock()
+	for _, cb := range pending {
+		cb(nil, err)
+	}
+}
+
+// roundTrip sends req and waits for the server response, a rejection is returned as an error
+func (c *Client) roundTrip(ctx context.Context, req mps.RequestPacket) error {
+	done := make(chan error, 1)
+	err := c.request(req, func(resp *mps.ResponsePacket, err error) {
+		if err == nil && !resp.Ok {
+			err = errors.Wrapf(ErrRejected, "%s", resp.Message)
+		}
+		done <- err
+	})
+	if err != nil {
+		return err
+	}
+	select {
+	case err = <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.closeCh:
+		return ErrClosed
+	}
+}
+
+func (c *Client) writeRequest(req mps.RequestPacket) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	conn := c.getConn()
+	if conn == nil {
+		return ErrNotConnected
+	}
+	conn.SetWriteDeadline(time.Now().Add(c.keepalive.Timeout))
+	return conn.WriteJSON(req)
+}
+
+// Subscribe subscribes topic and waits for the server to accept it, the txs of
+// TopicNewTx and TopicSnapshot can be narrowed by filter, which is nil otherwise.
+// Subscribing an already subscribed topic replaces its filter. Subscriptions are replayed
+// after reconnecting unless the server rejects them: on ErrConnLost or ctx done, the
+// subscription is kept and replayed, and is only forgotten if it's rejected later.
+// Responses are read along with the packets, which must be drained meanwhile,
+// see Stream and DrainLoop.
+func (c *Client) Subscribe(ctx context.Context, topic mps.Topic, filter *mps.TxFilter) error {
+	done := make(chan error, 1)
+	err := c.subscribe(topic, filter, func(err error) { done <- err })
+	if err == nil {
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-c.closeCh:
+			err = ErrClosed
+		}
+	}
+	return errors.Wrapf(err, "subscribe %s", topic)
+}
+
+// subscribe registers the subscription of topic and sends it, cb is called with its outcome.
+// A rejected subscription is rolled back to the previous one of topic if any.
+func (c *Client) subscribe(topic mps.Topic, filter *mps.TxFilter, cb func(err error)) error {
+	index := func() int {
+		return slices.IndexFunc(c.topics, func(sub subscription) bool { return sub.topic == topic })
+	}
+	c.topicsLock.Lock()
+	var prev *subscription
+	if i := index(); i < 0 {
+		c.topics = append(c.topics, subscription{topic, filter})
+	} else {
+		sub := c.topics[i]
+		prev = &sub
+		c.topics[i].filter = filter
 	}
-	err := c.conn.WriteJSON(req)
+	c.topicsLock.Unlock()
+	return c.request(mps.RequestPacket{
+		Op:     mps.ClientOptSubscribe,
+		Topic:  topic,
+		Filter: filter,
+	}, func(resp *mps.ResponsePacket, err error) {
+		if err == nil && !resp.Ok {
+			err = errors.Wrapf(ErrRejected, "%s", resp.Message)
+			// the server keeps the previous subscription of topic if any, unless it changed meanwhile
+			c.topicsLock.Lock()
+			if i := index(); i >= 0 && c.topics[i].filter == filter {
+				if prev != nil {
+					c.topics[i] = *prev
+				} else {
+					c.topics = slices.Delete(c.topics, i, i+1)
+				}
+			}
+			c.topicsLock.Unlock()
+		}
+		cb(err)
+	})
+}
+
+// subscribeTopic subscribes topic without waiting for the response, which is logged
+func (c *Client) subscribeTopic(topic mps.Topic, filter *mps.TxFilter) {
+	err := c.subscribe(topic, filter, func(err error) {
+		if err != nil {
+			log.Error("mps subscription failed", "url", c.url, "topic", topic, "err", err)
+		}
+	})
 	if err != nil {
-		log.Error(err.Error())
+		// the topic is replayed once the conn is recovered
+		log.Error("mps subscription not sent", "url", c.url, "topic", topic, "err", err)
 	}
 }
+
+// Deprecated: use Subscribe, which returns whether the server accepted the subscription.
 func (c *Client) SubscribeTopicNewTx() {
-	c.subscribeTopic(mps.TopicNewTx)
+	c.subscribeTopic(mps.TopicNewTx, nil)
+}
+
+// SubscribeTopicNewTxWithFilter only receives the new txs matching filter.
+//
+// Deprecated: use Subscribe, which returns whether the server accepted the subscription.
+func (c *Client) SubscribeTopicNewTxWithFilter(filter *mps.TxFilter) {
+	c.subscribeTopic(mps.TopicNewTx, filter)
 }
+
+// Deprecated: use Subscribe, which returns whether the server accepted the subscription.
 func (c *Client) SubscribeTopicBlockedTxHashes() {
-	c.subscribeTopic(mps.TopicBlockedTxHashes)
+	c.subscribeTopic(mps.TopicBlockedTxHashes, nil)
+}
+
+// Deprecated: use Subscribe, which returns whether the server accepted the subscription.
+func (c *Client) SubscribeTopicDroppedTxs() {
+	c.subscribeTopic(mps.TopicDroppedTxs, nil)
+}
+
+// Deprecated: use Subscribe, which returns whether the server accepted the subscription.
+func (c *Client) SubscribeTopicReorg() {
+	c.subscribeTopic(mps.TopicReorg, nil)
+}
+
+// SubscribeTopicSnapshot asks for the node's txpool content,
+// which is streamed again after every reconnect.
+//
+// Deprecated: use Subscribe, which returns whether the server accepted the subscription.
+func (c *Client) SubscribeTopicSnapshot() {
+	c.subscribeTopic(mps.TopicSnapshot, nil)
 }
 
-func (c *Client) unsubscribeTopic(t mps.Topic) error {
-	req := mps.RequestPacket{
+// Unsubscribe unsubscribes topic and waits for the server to acknowledge it
+func (c *Client) Unsubscribe(ctx context.Context, topic mps.Topic) error {
+	c.forget(topic)
+	err := c.roundTrip(ctx, mps.RequestPacket{
 		Op:    mps.ClientOptUnsubscribe,
-		Id:    int(time.Now().Unix()),
-		Topic: t,
-	}
-	return c.conn.WriteJSON(req)
+		Topic: topic,
+	})
+	return errors.Wrapf(err, "unsubscribe %s", topic)
 }
+
+// forget stops replaying topic after reconnecting
+func (c *Client) forget(topic mps.Topic) {
+	c.topicsLock.Lock()
+	c.topics = slices.DeleteFunc(c.topics, func(sub subscription) bool { return sub.topic == topic })
+	c.topicsLock.Unlock()
+	c.seqLock.Lock()
+	delete(c.lastSeq, topic)
+	c.seqLock.Unlock()
+}
+
+// unsubscribeTopic unsubscribes topic without waiting for the response
+func (c *Client) unsubscribeTopic(topic mps.Topic) error {
+	c.forget(topic)
+	return c.request(mps.RequestPacket{
+		Op:    mps.ClientOptUnsubscribe,
+		Topic: topic,
+	}, func(*mps.ResponsePacket, error) {})
+}
+
+// Deprecated: use Unsubscribe, which waits for the server to acknowledge it.
 func (c *Client) UnsubscribeTopicNewTx() error {
 	return c.unsubscribeTopic(mps.TopicNewTx)
 }
+
+// Deprecated: use Unsubscribe, which waits for the server to acknowledge it.
 func (c *Client) UnsubscribeTopicBlockedTxHashes() error {
 	return c.unsubscribeTopic(mps.TopicBlockedTxHashes)
 }
+
+// Deprecated: use Unsubscribe, which waits for the server to acknowledge it.
+func (c *Client) UnsubscribeTopicDroppedTxs() error {
+	return c.unsubscribeTopic(mps.TopicDroppedTxs)
+}
+
+// Deprecated: use Unsubscribe, which waits for the server to acknowledge it.
+func (c *Client) UnsubscribeTopicReorg() error {
+	return c.unsubscribeTopic(mps.TopicReorg)
+}
@@ -0,0 +1,367 @@
+package mpsclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+
+	"github.com/moodbase/TxForesight/mps"
+)
+
+func TestBackoffNext(t *testing.T) {
+	b := Backoff{Initial: time.Second, Max: 5 * time.Second, Multiplier: 2}
+	want := []time.Duration{2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	delay := b.Initial
+	for i, w := range want {
+		delay = b.next(delay)
+		if delay != w {
+			t.Errorf("step %d: delay = %v, want %v", i, delay, w)
+		}
+	}
+}
+
+// serverHandshake plays the server side of the handshake on c
+func serverHandshake(t *testing.T, c *websocket.Conn, hello *mps.Hello) bool {
+	data, _ := json.Marshal(hello)
+	if err := c.WriteJSON(mps.FeedPacket{Type: mps.FeedTypeHello, Data: data}); err != nil {
+		return false
+	}
+	var req mps.RequestPacket
+	if err := c.ReadJSON(&req); err != nil {
+		return false
+	}
+	if req.Op != mps.ClientOptHello || req.Hello == nil || req.Hello.Version != mps.ProtocolVersion {
+		t.Errorf("unexpected hello request %+v", req)
+		return false
+	}
+	return respond(c, req.Id, true, "")
+}
+
+func respond(c *websocket.Conn, id int, ok bool, msg string) bool {
+	data, _ := json.Marshal(mps.ResponsePacket{Id: id, Ok: ok, Message: msg})
+	return c.WriteJSON(mps.FeedPacket{Type: mps.FeedTypeResponse, Data: data}) == nil
+}
+
+func TestClientReconnectResubscribe(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	reqs := make(chan mps.RequestPacket, 8)
+	var conns atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		hello := mps.NewHello()
+		hello.Epoch = "e1"
+		if !serverHandshake(t, c, hello) {
+			return
+		}
+		n := conns.Add(1)
+		var req mps.RequestPacket
+		if err := c.ReadJSON(&req); err != nil {
+			return
+		}
+		reqs <- req
+		respond(c, req.Id, true, "")
+		if n == 1 {
+			// drop the first conn right after the subscription and a packet
+			c.WriteJSON(mps.FeedPacket{Type: mps.FeedTypeBlockedTxHashes, Data: []byte("[]"), Seq: 7})
+			return
+		}
+		c.WriteJSON(mps.FeedPacket{Type: mps.FeedTypeBlockedTxHashes, Data: []byte("[]")})
+		c.ReadMessage()
+	}))
+	defer srv.Close()
+
+	states := make(chan ConnState, 8)
+	b := Backoff{Initial: 10 * time.Millisecond, Max: 10 * time.Millisecond, Multiplier: 1}
+	c, err := New(strings.TrimPrefix(srv.URL, "http://"), WithBackoff(b), WithStateHandler(func(state ConnState, err error) {
+		states <- state
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Subscribe(context.Background(), mps.TopicBlockedTxHashes, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case req := <-reqs:
+			if req.Op != mps.ClientOptSubscribe || req.Topic != mps.TopicBlockedTxHashes {
+				t.Errorf("conn %d: unexpected request %+v", i, req)
+			}
+			// the resubscription resumes from the packet received, within the epoch of its server
+			if i == 1 && (req.ResumeFrom == nil || *req.ResumeFrom != 7 || req.Epoch != "e1") {
+				t.Errorf("resubscription resumes from %v epoch %q, want 7 e1", req.ResumeFrom, req.Epoch)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("conn %d: subscription not received", i)
+		}
+	}
+	ch := make(chan *mps.FeedPacket, 1)
+	go c.DrainLoop(ch)
+	select {
+	case p := <-ch:
+		if p.Type != mps.FeedTypeBlockedTxHashes {
+			t.Errorf("packet type = %d, want %d", p.Type, mps.FeedTypeBlockedTxHashes)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no packet after reconnect")
+	}
+	want := []ConnState{StateConnected, StateReconnecting, StateConnected}
+	for i, w := range want {
+		if s := <-states; s != w {
+			t.Errorf("state %d = %v, want %v", i, s, w)
+		}
+	}
+}
+
+func TestClientBackgroundDial(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	ready := make(chan struct{})
+	reqs := make(chan mps.RequestPacket, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the server is unavailable until ready
+		select {
+		case <-ready:
+		default:
+			http.Error(w, "starting", http.StatusServiceUnavailable)
+			return
+		}
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if !serverHandshake(t, c, mps.NewHello()) {
+			return
+		}
+		var req mps.RequestPacket
+		if err := c.ReadJSON(&req); err != nil {
+			return
+		}
+		reqs <- req
+		respond(c, req.Id, true, "")
+		c.ReadMessage()
+	}))
+	defer srv.Close()
+
+	states := make(chan ConnState, 8)
+	b := Backoff{Initial: 10 * time.Millisecond, Max: 10 * time.Millisecond, Multiplier: 1}
+	c, err := New(strings.TrimPrefix(srv.URL, "http://"), WithBackoff(b), WithBackgroundDial(),
+		WithStateHandler(func(state ConnState, err error) {
+			states <- state
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// subscribed before the first conn, and sent once connected
+	if err := c.Subscribe(context.Background(), mps.TopicDroppedTxs, nil); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("err = %v, want not connected", err)
+	}
+	close(ready)
+	select {
+	case req := <-reqs:
+		if req.Topic != mps.TopicDroppedTxs {
+			t.Errorf("unexpected request %+v", req)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscription not sent once connected")
+	}
+	for s := range states {
+		if s == StateConnected {
+			break
+		}
+		if s != StateReconnecting {
+			t.Fatalf("state = %v, want reconnecting until connected", s)
+		}
+	}
+}
+
+func TestClientTLS(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if serverHandshake(t, c, mps.NewHello()) {
+			c.ReadMessage()
+		}
+	}))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "https://")
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	c, err := New(addr, WithTLSConfig(&tls.Config{RootCAs: pool}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if c.url != "wss://"+addr+"/" {
+		t.Errorf("url = %s, want wss://%s/", c.url, addr)
+	}
+
+	if _, err := New(addr, WithTLSConfig(&tls.Config{})); err == nil {
+		t.Error("expected error on untrusted certificate")
+	}
+
+	// the CA bundle is kept whatever the order of the options, and added to the root CAs
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	unrelated := x509.NewCertPool()
+	for _, opts := range [][]Option{
+		{WithCABundle(bundle), WithTLSConfig(&tls.Config{RootCAs: unrelated})},
+		{WithTLSConfig(&tls.Config{RootCAs: unrelated}), WithCABundle(bundle)},
+	} {
+		c, err := New(addr, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+}
+
+func TestClientIncompatibleServer(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if r.URL.Path == "/legacy" {
+			// servers predating the handshake start with the chain config
+			c.WriteJSON(mps.FeedPacket{Type: mps.FeedTypeChainConfig, Data: []byte("{}")})
+		} else {
+			data, _ := json.Marshal(mps.Hello{Version: mps.ProtocolVersion + 2, MinVersion: mps.ProtocolVersion + 1})
+			c.WriteJSON(mps.FeedPacket{Type: mps.FeedTypeHello, Data: data})
+		}
+		c.ReadMessage()
+	}))
+	defer srv.Close()
+	for _, path := range []string{"/legacy", "/future"} {
+		_, err := New("ws" + strings.TrimPrefix(srv.URL, "http") + path)
+		if !errors.Is(err, mps.ErrIncompatibleProtocol) {
+			t.Errorf("%s: err = %v, want incompatible protocol", path, err)
+		}
+	}
+}
+
+func TestClientKeepalive(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if serverHandshake(t, c, mps.NewHello()) {
+			// never read again, so that the pings are left unanswered
+			time.Sleep(time.Second)
+		}
+	}))
+	defer srv.Close()
+
+	states := make(chan ConnState, 8)
+	c, err := New(strings.TrimPrefix(srv.URL, "http://"),
+		WithKeepalive(Keepalive{Interval: 20 * time.Millisecond, Timeout: 20 * time.Millisecond}),
+		WithStateHandler(func(state ConnState, err error) {
+			states <- state
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	<-states
+	select {
+	case s := <-states:
+		if s != StateReconnecting {
+			t.Errorf("state = %v, want %v", s, StateReconnecting)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Error("dead server not detected")
+	}
+}
+
+func TestClientSubscribe(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if !serverHandshake(t, c, mps.NewHello()) {
+			return
+		}
+		var reqs []mps.RequestPacket
+		for len(reqs) < 3 {
+			var req mps.RequestPacket
+			if err := c.ReadJSON(&req); err != nil {
+				return
+			}
+			reqs = append(reqs, req)
+		}
+		// respond out of order, the responses are routed by id
+		for i := len(reqs) - 1; i >= 0; i-- {
+			respond(c, reqs[i].Id, reqs[i].Topic != mps.TopicReorg, "topic not permitted")
+		}
+		c.ReadMessage()
+	}))
+	defer srv.Close()
+
+	c, err := New(strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	errs := make(chan error, 3)
+	for _, topic := range []mps.Topic{mps.TopicNewTx, mps.TopicReorg, mps.TopicDroppedTxs} {
+		go func() {
+			err := c.Subscribe(ctx, topic, nil)
+			if (topic == mps.TopicReorg) != errors.Is(err, ErrRejected) {
+				t.Errorf("%s: err = %v", topic, err)
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		<-errs
+	}
+	// a subscription left without response, by a timeout or the conn loss, is kept to be replayed
+	short, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.Subscribe(short, mps.TopicBlockedTxHashes, nil); !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, ErrConnLost) {
+		t.Errorf("err = %v, want deadline exceeded or conn lost", err)
+	}
+	c.topicsLock.Lock()
+	defer c.topicsLock.Unlock()
+	if len(c.topics) != 3 || slices.ContainsFunc(c.topics, func(sub subscription) bool { return sub.topic == mps.TopicReorg }) {
+		t.Errorf("topics = %v, want the rejected one forgotten and the unanswered one kept", c.topics)
+	}
+}
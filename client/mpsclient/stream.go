@@ -0,0 +1,147 @@
+package mpsclient
+
+import (
+	"context"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/pkg/errors"
+
+	"github.com/moodbase/TxForesight/mps"
+)
+
+// Stream delivers the packets of a client decoded, one channel per packet type.
+// The channels are unbuffered and fed one packet at a time in the order received,
+// so a consumer receiving from all of them in a single select keeps that order.
+// Every channel must be drained, a channel left alone blocks the others.
+// Done is closed once the stream ends, the cause is sent to Errors beforehand if any.
+type Stream struct {
+	ChainConfig     <-chan *params.ChainConfig
+	Txs             <-chan *mps.TxsWithSender
+	BlockedTxHashes <-chan []common.Hash
+	Snapshots       <-chan *mps.SnapshotPacket
+	Dropped         <-chan []mps.DroppedTx
+	Reorgs          <-chan *mps.ReorgEvent
+	Gaps            <-chan *mps.GapPacket
+	// Errors reports the packets which can't be decoded, the failures reported by the server
+	// outside of any request, and why the client gave up reconnecting
+	Errors <-chan error
+	Done   <-chan struct{}
+}
+
+type stream struct {
+	chainConfig     chan *params.ChainConfig
+	txs             chan *mps.TxsWithSender
+	blockedTxHashes chan []common.Hash
+	snapshots       chan *mps.SnapshotPacket
+	dropped         chan []mps.DroppedTx
+	reorgs          chan *mps.ReorgEvent
+	gaps            chan *mps.GapPacket
+	errors          chan error
+	done            chan struct{}
+}
+
+// Stream decodes the packets of the client until ctx is done, the client is closed
+// or gives up reconnecting. It consumes the same packets as DrainLoop, only one of them may be used.
+func (c *Client) Stream(ctx context.Context) *Stream {
+	s := &stream{
+		chainConfig:     make(chan *params.ChainConfig),
+		txs:             make(chan *mps.TxsWithSender),
+		blockedTxHashes: make(chan []common.Hash),
+		snapshots:       make(chan *mps.SnapshotPacket),
+		dropped:         make(chan []mps.DroppedTx),
+		reorgs:          make(chan *mps.ReorgEvent),
+		gaps:            make(chan *mps.GapPacket),
+		errors:          make(chan error),
+		done:            make(chan struct{}),
+	}
+	go c.streamLoop(ctx, s)
+	return &Stream{
+		ChainConfig:     s.chainConfig,
+		Txs:             s.txs,
+		BlockedTxHashes: s.blockedTxHashes,
+		Snapshots:       s.snapshots,
+		Dropped:         s.dropped,
+		Reorgs:          s.reorgs,
+		Gaps:            s.gaps,
+		Errors:          s.errors,
+		Done:            s.done,
+	}
+}
+
+func (c *Client) streamLoop(ctx context.Context, s *stream) {
+	defer close(s.done)
+	for {
+		var (
+			packet *mps.FeedPacket
+			ok     bool
+		)
+		select {
+		case packet, ok = <-c.packets:
+		case <-ctx.Done():
+			return
+		}
+		if !ok {
+			// c.err is set before packets is closed
+			if c.err != nil {
+				send(ctx, s.errors, errors.Wrap(c.err, "mps client gave up"))
+			}
+			return
+		}
+		if err := s.dispatch(ctx, packet); err != nil {
+			send(ctx, s.errors, err)
+		}
+	}
+}
+
+// dispatch decodes packet and sends it to its channel
+func (s *stream) dispatch(ctx context.Context, packet *mps.FeedPacket) error {
+	var err error
+	switch packet.Type {
+	case mps.FeedTypeChainConfig:
+		err = decodeAndSend(ctx, packet, s.chainConfig)
+	case mps.FeedTypeTransactions:
+		err = decodeAndSend(ctx, packet, s.txs)
+	case mps.FeedTypeBlockedTxHashes:
+		var hashes []common.Hash
+		if err = packet.Decode(&hashes); err == nil {
+			send(ctx, s.blockedTxHashes, hashes)
+		}
+	case mps.FeedTypeSnapshot:
+		err = decodeAndSend(ctx, packet, s.snapshots)
+	case mps.FeedTypeDroppedTxs:
+		var dropped []mps.DroppedTx
+		if err = packet.Decode(&dropped); err == nil {
+			send(ctx, s.dropped, dropped)
+		}
+	case mps.FeedTypeReorg:
+		err = decodeAndSend(ctx, packet, s.reorgs)
+	case mps.FeedTypeGap:
+		err = decodeAndSend(ctx, packet, s.gaps)
+	case mps.FeedTypeResponse:
+		// responses to the requests of the client never get here
+		var resp mps.ResponsePacket
+		if err = packet.Decode(&resp); err == nil && !resp.Ok {
+			err = errors.Wrapf(ErrRejected, "%s", resp.Message)
+		}
+	default:
+		err = errors.Errorf("unknown packet type %d", packet.Type)
+	}
+	return errors.Wrapf(err, "packet type %d", packet.Type)
+}
+
+func decodeAndSend[T any](ctx context.Context, packet *mps.FeedPacket, ch chan<- *T) error {
+	v := new(T)
+	if err := packet.Decode(v); err != nil {
+		return err
+	}
+	send(ctx, ch, v)
+	return nil
+}
+
+func send[T any](ctx context.Context, ch chan<- T, v T) {
+	select {
+	case ch <- v:
+	case <-ctx.Done():
+	}
+}
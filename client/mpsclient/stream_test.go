@@ -0,0 +1,91 @@
+package mpsclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/moodbase/TxForesight/mps"
+)
+
+func TestClientStream(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	var served atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if served.Swap(true) {
+			// refuse reconnecting
+			http.Error(w, "gone", http.StatusServiceUnavailable)
+			return
+		}
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if !serverHandshake(t, c, mps.NewHello()) {
+			return
+		}
+		for _, p := range []mps.FeedPacket{
+			{Type: mps.FeedTypeChainConfig, Data: []byte(`{"chainId":1}`)},
+			{Type: mps.FeedTypeBlockedTxHashes, Data: []byte(`["0x0100000000000000000000000000000000000000000000000000000000000000"]`), Seq: 1},
+			{Type: mps.FeedTypeBlockedTxHashes, Data: []byte(`"invalid"`), Seq: 2},
+			{Type: mps.FeedTypeGap, Data: []byte(`{"topic":"newTx","resumeFrom":1,"oldest":3,"latest":5}`)},
+			// seq 3 is lost
+			{Type: mps.FeedTypeBlockedTxHashes, Data: []byte(`["0x0100000000000000000000000000000000000000000000000000000000000000"]`), Seq: 4, Prev: 3},
+			// seq 5 is filtered out
+			{Type: mps.FeedTypeBlockedTxHashes, Data: []byte(`["0x0100000000000000000000000000000000000000000000000000000000000000"]`), Seq: 6, Prev: 4},
+		} {
+			c.WriteJSON(p)
+		}
+	}))
+	defer srv.Close()
+
+	b := Backoff{Initial: 10 * time.Millisecond, Max: 10 * time.Millisecond, Multiplier: 1, MaxRetries: 1}
+	c, err := New(strings.TrimPrefix(srv.URL, "http://"), WithBackoff(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	stream := c.Stream(ctx)
+
+	var got []string
+	for done := false; !done; {
+		select {
+		case config := <-stream.ChainConfig:
+			if config.ChainID.Uint64() != 1 {
+				t.Errorf("chain id = %v, want 1", config.ChainID)
+			}
+			got = append(got, "config")
+		case hashes := <-stream.BlockedTxHashes:
+			if len(hashes) != 1 || hashes[0][0] != 1 {
+				t.Errorf("unexpected hashes %v", hashes)
+			}
+			got = append(got, "blocked")
+		case gap := <-stream.Gaps:
+			if (gap.Topic != mps.TopicNewTx || gap.Oldest != 3) && (gap.Topic != mps.TopicBlockedTxHashes || gap.ResumeFrom != 2 || gap.Oldest != 4) {
+				t.Errorf("unexpected gap %+v", gap)
+			}
+			got = append(got, "gap")
+		case <-stream.Errors:
+			got = append(got, "error")
+		case <-stream.Done:
+			done = true
+		}
+	}
+	// the packets keep their order, the stream ends with the reason to give up
+	want := []string{"config", "blocked", "error", "gap", "gap", "blocked", "blocked", "error"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("stream = %v, want %v", got, want)
+	}
+	if ctx.Err() != nil {
+		t.Error("stream not ended by the client giving up")
+	}
+}
@@ -0,0 +1,134 @@
+package mps
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pkg/errors"
+)
+
+var ErrUnauthorized = errors.New("unauthorized")
+
+// jwtExpiryTimeout is the max drift of the iat claim, same as geth's engine API
+const jwtExpiryTimeout = 60 * time.Second
+
+// TokenConfig is a static bearer token and the topics it may subscribe, empty Topics allows any topic
+type TokenConfig struct {
+	Token  string
+	Topics []Topic
+}
+
+// AuthConfig enables the authentication of MPS clients, which send a token in the
+// "Authorization: Bearer <token>" header of the websocket upgrade request.
+// Both static tokens and HS256 JWTs are accepted when configured.
+type AuthConfig struct {
+	Tokens []TokenConfig
+
+	// JWTSecret is the 32 bytes HS256 secret, see LoadJWTSecret.
+	// JWTs must carry an iat claim within 60 seconds of the server time.
+	JWTSecret []byte
+	// JWTTopics are the topics JWT authenticated clients may subscribe, empty allows any topic
+	JWTTopics []Topic
+}
+
+func (a *AuthConfig) enabled() bool {
+	return len(a.Tokens) > 0 || len(a.JWTSecret) > 0
+}
+
+func (a *AuthConfig) validate() error {
+	for i, t := range a.Tokens {
+		if t.Token == "" {
+			return errors.Errorf("empty auth token #%d", i)
+		}
+		if err := validateTopics(t.Topics); err != nil {
+			return err
+		}
+	}
+	if len(a.JWTSecret) > 0 && len(a.JWTSecret) != 32 {
+		return errors.Errorf("invalid jwt secret length %d, want 32", len(a.JWTSecret))
+	}
+	return validateTopics(a.JWTTopics)
+}
+
+func validateTopics(topics []Topic) error {
+	for _, t := range topics {
+		if !supportTopics[t] {
+			return errors.Errorf("unknown topic %q", t)
+		}
+	}
+	return nil
+}
+
+// LoadJWTSecret reads a hex encoded secret file, in the same format as geth's --authrpc.jwtsecret
+func LoadJWTSecret(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secret := common.FromHex(strings.TrimSpace(string(data)))
+	if len(secret) != 32 {
+		return nil, errors.Errorf("invalid jwt secret in %s", path)
+	}
+	return secret, nil
+}
+
+// authenticate checks the bearer token of the upgrade request, and returns the topics
+// the client may subscribe, nil allows any topic
+func (a *AuthConfig) authenticate(r *http.Request) (map[Topic]bool, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, errors.Wrap(ErrUnauthorized, "missing token")
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	for _, t := range a.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+			return topicSet(t.Topics), nil
+		}
+	}
+	if len(a.JWTSecret) == 0 {
+		return nil, errors.Wrap(ErrUnauthorized, "invalid token")
+	}
+	if err := a.verifyJWT(token); err != nil {
+		return nil, errors.Wrap(ErrUnauthorized, err.Error())
+	}
+	return topicSet(a.JWTTopics), nil
+}
+
+// verifyJWT applies the same checks as geth's engine API
+func (a *AuthConfig) verifyJWT(token string) error {
+	var claims jwt.RegisteredClaims
+	t, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (interface{}, error) {
+		return a.JWTSecret, nil
+	}, jwt.WithValidMethods([]string{"HS256"}), jwt.WithoutClaimsValidation())
+	switch {
+	case err != nil:
+		return err
+	case !t.Valid:
+		return errors.New("invalid token")
+	case !claims.VerifyExpiresAt(time.Now(), false):
+		return errors.New("token is expired")
+	case claims.IssuedAt == nil:
+		return errors.New("missing issued-at")
+	case time.Since(claims.IssuedAt.Time) > jwtExpiryTimeout:
+		return errors.New("stale token")
+	case time.Until(claims.IssuedAt.Time) > jwtExpiryTimeout:
+		return errors.New("future token")
+	}
+	return nil
+}
+
+func topicSet(topics []Topic) map[Topic]bool {
+	if len(topics) == 0 {
+		return nil
+	}
+	set := make(map[Topic]bool, len(topics))
+	for _, t := range topics {
+		set[t] = true
+	}
+	return set
+}
@@ -0,0 +1,76 @@
+package mps
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func jwtToken(t *testing.T, secret []byte, iat time.Time) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iat": &jwt.NumericDate{Time: iat},
+	}).SignedString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestAuthenticate(t *testing.T) {
+	secret := make([]byte, 32)
+	secret[0] = 1
+	auth := AuthConfig{
+		Tokens:    []TokenConfig{{Token: "all"}, {Token: "blocks", Topics: []Topic{TopicBlockedTxHashes}}},
+		JWTSecret: secret,
+		JWTTopics: []Topic{TopicNewTx},
+	}
+	if err := auth.validate(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		token   string
+		ok      bool
+		allowed Topic // a topic allowed by the token, empty if every topic is
+	}{
+		{"", false, ""},
+		{"none", false, ""},
+		{"all", true, ""},
+		{"blocks", true, TopicBlockedTxHashes},
+		{jwtToken(t, secret, time.Now()), true, TopicNewTx},
+		{jwtToken(t, secret, time.Now().Add(-2*time.Minute)), false, ""},
+		{jwtToken(t, make([]byte, 32), time.Now()), false, ""},
+	}
+	for i, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		allowed, err := auth.authenticate(r)
+		if (err == nil) != test.ok {
+			t.Errorf("test %d: err = %v, want ok %v", i, err, test.ok)
+			continue
+		}
+		if test.allowed == "" {
+			if allowed != nil {
+				t.Errorf("test %d: allowed = %v, want any topic", i, allowed)
+			}
+		} else if len(allowed) != 1 || !allowed[test.allowed] {
+			t.Errorf("test %d: allowed = %v, want %s only", i, allowed, test.allowed)
+		}
+	}
+}
+
+func TestAuthValidate(t *testing.T) {
+	bad := []AuthConfig{
+		{Tokens: []TokenConfig{{Token: ""}}},
+		{Tokens: []TokenConfig{{Token: "t", Topics: []Topic{"unknown"}}}},
+		{JWTSecret: []byte{1, 2, 3}},
+	}
+	for i, auth := range bad {
+		if err := auth.validate(); err == nil {
+			t.Errorf("test %d: expected error", i)
+		}
+	}
+}
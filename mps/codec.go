@@ -0,0 +1,155 @@
+package mps
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// Encoding is the wire encoding of FeedPackets, negotiated as the websocket subprotocol
+// when connecting. Clients which don't ask for any subprotocol get EncodingJSON.
+type Encoding string
+
+const (
+	// EncodingJSON sends FeedPackets as JSON text frames, with JSON payloads
+	EncodingJSON Encoding = "mps.json"
+	// EncodingRLP sends FeedPackets as RLP binary frames. The payloads of txs, hashes,
+	// snapshots, drops and reorgs are RLP encoded too, txs with go-ethereum's encoding,
+	// the other payloads stay JSON.
+	EncodingRLP Encoding = "mps.rlp"
+)
+
+// SupportEncodings are the encodings served by MPS, by order of preference
+var SupportEncodings = []Encoding{EncodingRLP, EncodingJSON}
+
+// rlpPayloads are the feed types whose payload is RLP encoded under EncodingRLP
+var rlpPayloads = map[FeedType]bool{
+	FeedTypeTransactions:    true,
+	FeedTypeBlockedTxHashes: true,
+	FeedTypeSnapshot:        true,
+	FeedTypeDroppedTxs:      true,
+	FeedTypeReorg:           true,
+}
+
+// rlpFeedPacket is the RLP form of FeedPacket
+type rlpFeedPacket struct {
+	Type uint64
+	Seq  uint64
+	Time uint64
+	Data []byte
+	Prev uint64 `rlp:"optional"`
+}
+
+// encodingOf returns the encoding of a negotiated subprotocol
+func encodingOf(subprotocol string) Encoding {
+	if Encoding(subprotocol) == EncodingRLP {
+		return EncodingRLP
+	}
+	return EncodingJSON
+}
+
+// encodePayload encodes the payload of a packet of type t
+func encodePayload(enc Encoding, t FeedType, v any) ([]byte, error) {
+	if enc == EncodingRLP && rlpPayloads[t] {
+		return rlp.EncodeToBytes(v)
+	}
+	return json.Marshal(v)
+}
+
+// EncodePacket encodes p into a websocket message
+func EncodePacket(enc Encoding, p *FeedPacket) (messageType int, data []byte, err error) {
+	if enc != EncodingRLP {
+		data, err = json.Marshal(p)
+		return websocket.TextMessage, data, err
+	}
+	data, err = rlp.EncodeToBytes(&rlpFeedPacket{
+		Type: uint64(p.Type),
+		Seq:  p.Seq,
+		Time: uint64(p.Time),
+		Data: p.Data,
+		Prev: p.Prev,
+	})
+	return websocket.BinaryMessage, data, err
+}
+
+// DecodePacket decodes a websocket message into a FeedPacket, whose payload is then decoded by FeedPacket.Decode
+func DecodePacket(messageType int, data []byte) (*FeedPacket, error) {
+	switch messageType {
+	case websocket.TextMessage:
+		p := &FeedPacket{enc: EncodingJSON}
+		if err := json.Unmarshal(data, p); err != nil {
+			return nil, err
+		}
+		return p, nil
+	case websocket.BinaryMessage:
+		var rp rlpFeedPacket
+		if err := rlp.DecodeBytes(data, &rp); err != nil {
+			return nil, err
+		}
+		return &FeedPacket{
+			Type: FeedType(rp.Type),
+			Data: rp.Data,
+			Seq:  rp.Seq,
+			Time: int64(rp.Time),
+			Prev: rp.Prev,
+			enc:  EncodingRLP,
+		}, nil
+	default:
+		return nil, errors.Errorf("unexpected websocket message type %d", messageType)
+	}
+}
+
+// Decode decodes the payload of the packet into v, according to the encoding it was received with
+func (p *FeedPacket) Decode(v any) error {
+	if p.enc == EncodingRLP && rlpPayloads[p.Type] {
+		return rlp.DecodeBytes(p.Data, v)
+	}
+	return json.Unmarshal(p.Data, v)
+}
+
+// rlpTxsWithSender is the RLP form of TxsWithSender, unknown senders are empty
+type rlpTxsWithSender struct {
+	Txs     []*types.Transaction
+	Senders [][]byte
+}
+
+func (t TxsWithSender) EncodeRLP(w io.Writer) error {
+	enc := rlpTxsWithSender{
+		Txs:     t.Txs,
+		Senders: make([][]byte, len(t.Senders)),
+	}
+	for i, sender := range t.Senders {
+		if sender != nil {
+			enc.Senders[i] = sender.Bytes()
+		}
+	}
+	return rlp.Encode(w, &enc)
+}
+
+func (t *TxsWithSender) DecodeRLP(s *rlp.Stream) error {
+	var dec rlpTxsWithSender
+	if err := s.Decode(&dec); err != nil {
+		return err
+	}
+	if len(dec.Txs) != len(dec.Senders) {
+		return errors.Errorf("txs and senders mismatch: %d != %d", len(dec.Txs), len(dec.Senders))
+	}
+	t.Txs = dec.Txs
+	t.Senders = make([]*common.Address, len(dec.Senders))
+	for i, sender := range dec.Senders {
+		switch len(sender) {
+		case 0:
+		case common.AddressLength:
+			addr := common.BytesToAddress(sender)
+			t.Senders[i] = &addr
+		default:
+			return errors.Errorf("invalid sender length %d", len(sender))
+		}
+	}
+	return nil
+}
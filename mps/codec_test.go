@@ -0,0 +1,109 @@
+package mps
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gorilla/websocket"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	txs := TxsWithSender{
+		Txs:     types.Transactions{signedTx(t, key, 0), signedTx(t, key, 1)},
+		Senders: []*common.Address{&from, nil},
+	}
+	replacedBy := common.Hash{0x02}
+	dropped := []DroppedTx{
+		{Hash: common.Hash{0x01}, Reason: DropReasonReplaced, ReplacedBy: &replacedBy},
+		{Hash: common.Hash{0x03}, Reason: DropReasonMined},
+	}
+	reorg := &ReorgEvent{
+		OldHead:    common.Hash{0x04},
+		OldNumber:  10,
+		NewHead:    common.Hash{0x05},
+		NewNumber:  11,
+		Depth:      2,
+		Reinjected: txs,
+		Included:   []common.Hash{{0x06}},
+	}
+	snapshot := SnapshotPacket{Pending: txs, Done: true} // empty queued
+	gap := GapPacket{Topic: TopicNewTx, ResumeFrom: 1, Oldest: 3, Latest: 5}
+	for _, enc := range SupportEncodings {
+		for _, test := range []struct {
+			t       FeedType
+			payload any
+			decoded any
+		}{
+			{FeedTypeTransactions, txs, new(TxsWithSender)},
+			{FeedTypeDroppedTxs, dropped, new([]DroppedTx)},
+			{FeedTypeResponse, ResponsePacket{Id: 1, Ok: true, Message: "ok"}, new(ResponsePacket)},
+			{FeedTypeReorg, reorg, new(ReorgEvent)},
+			{FeedTypeSnapshot, snapshot, new(SnapshotPacket)},
+			{FeedTypeGap, gap, new(GapPacket)},
+		} {
+			data, err := encodePayload(enc, test.t, test.payload)
+			if err != nil {
+				t.Fatalf("%s %d: %v", enc, test.t, err)
+			}
+			messageType, msg, err := EncodePacket(enc, &FeedPacket{Type: test.t, Data: data, Seq: 7, Time: 42, Prev: 6})
+			if err != nil {
+				t.Fatalf("%s %d: %v", enc, test.t, err)
+			}
+			if want := websocket.TextMessage; enc == EncodingRLP {
+				want = websocket.BinaryMessage
+				if messageType != want {
+					t.Errorf("%s: message type = %d, want %d", enc, messageType, want)
+				}
+			}
+			p, err := DecodePacket(messageType, msg)
+			if err != nil {
+				t.Fatalf("%s %d: %v", enc, test.t, err)
+			}
+			if p.Type != test.t || p.Seq != 7 || p.Time != 42 || p.Prev != 6 {
+				t.Errorf("%s: packet = %d seq %d time %d prev %d", enc, p.Type, p.Seq, p.Time, p.Prev)
+			}
+			if err := p.Decode(test.decoded); err != nil {
+				t.Fatalf("%s %d: %v", enc, test.t, err)
+			}
+			switch decoded := test.decoded.(type) {
+			case *TxsWithSender:
+				if len(decoded.Txs) != 2 || decoded.Txs[1].Hash() != txs.Txs[1].Hash() {
+					t.Errorf("%s: txs mismatch", enc)
+				}
+				if decoded.Senders[0] == nil || *decoded.Senders[0] != from || decoded.Senders[1] != nil {
+					t.Errorf("%s: senders = %v, want [%v nil]", enc, decoded.Senders, from)
+				}
+			case *[]DroppedTx:
+				if len(*decoded) != 2 || *(*decoded)[0].ReplacedBy != replacedBy || (*decoded)[1].ReplacedBy != nil {
+					t.Errorf("%s: dropped = %+v", enc, *decoded)
+				}
+			case *ResponsePacket:
+				if !decoded.Ok || decoded.Id != 1 {
+					t.Errorf("%s: response = %+v", enc, *decoded)
+				}
+			case *ReorgEvent:
+				if decoded.OldHead != reorg.OldHead || decoded.NewNumber != 11 || decoded.Depth != 2 ||
+					len(decoded.Included) != 1 || decoded.Included[0] != reorg.Included[0] {
+					t.Errorf("%s: reorg = %+v", enc, *decoded)
+				}
+				if len(decoded.Reinjected.Txs) != 2 || decoded.Reinjected.Txs[0].Hash() != txs.Txs[0].Hash() ||
+					*decoded.Reinjected.Senders[0] != from || decoded.Reinjected.Senders[1] != nil {
+					t.Errorf("%s: reinjected = %+v", enc, decoded.Reinjected)
+				}
+			case *SnapshotPacket:
+				if !decoded.Done || len(decoded.Pending.Txs) != 2 || decoded.Pending.Txs[1].Hash() != txs.Txs[1].Hash() ||
+					decoded.Pending.Senders[1] != nil || len(decoded.Queued.Txs) != 0 {
+					t.Errorf("%s: snapshot = %+v", enc, *decoded)
+				}
+			case *GapPacket:
+				if *decoded != gap {
+					t.Errorf("%s: gap = %+v, want %+v", enc, *decoded, gap)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package mps
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Config is the configuration of the MPS websocket server
+type Config struct {
+	ListenAddr string
+	Path       string // websocket endpoint path
+
+	// AllowedOrigins lists the browser origins (scheme://host[:port]) allowed to connect,
+	// "*" allows any origin. When empty only same-origin requests are accepted.
+	// Requests without Origin header, which are not sent by browsers, are always accepted.
+	AllowedOrigins []string
+
+	MaxMessageSize   int64         // max size of a client request in bytes
+	HandshakeTimeout time.Duration // max duration of the websocket upgrade
+	WriteTimeout     time.Duration // max duration of writing one packet
+	// ReadTimeout is the max silence of a client, any request or pong received resets it.
+	// It must exceed PingInterval, as the clients which only answer pings would time out,
+	// and only tightens PongTimeout below PingInterval+PongTimeout. 0 relies on the pings only.
+	ReadTimeout time.Duration
+	// PingInterval is the interval of the pings sent to clients, a client which sends
+	// neither a pong nor a request within PongTimeout after a ping is disconnected
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+	MaxConns     int // max concurrent clients, negative is unlimited
+
+	SendQueue SendQueueConfig
+	// ReplayBufferSize is the number of packets kept per topic for resuming clients
+	ReplayBufferSize int
+
+	// Auth requires clients to authenticate when any token or secret is configured
+	Auth AuthConfig
+	TLS  TLSConfig
+}
+
+var DefaultConfig = Config{
+	ListenAddr:       ":7856",
+	Path:             "/",
+	MaxMessageSize:   32 * 1024,
+	HandshakeTimeout: 10 * time.Second,
+	WriteTimeout:     10 * time.Second,
+	PingInterval:     30 * time.Second,
+	PongTimeout:      10 * time.Second,
+	MaxConns:         64,
+	SendQueue:        DefaultSendQueueConfig,
+	ReplayBufferSize: 1024,
+}
+
+// withDefaults returns a copy of c whose unset fields are taken from DefaultConfig
+func (c Config) withDefaults() Config {
+	if c.ListenAddr == "" {
+		c.ListenAddr = DefaultConfig.ListenAddr
+	}
+	if c.Path == "" {
+		c.Path = DefaultConfig.Path
+	}
+	if c.MaxMessageSize == 0 {
+		c.MaxMessageSize = DefaultConfig.MaxMessageSize
+	}
+	if c.HandshakeTimeout == 0 {
+		c.HandshakeTimeout = DefaultConfig.HandshakeTimeout
+	}
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = DefaultConfig.WriteTimeout
+	}
+	if c.PingInterval == 0 {
+		c.PingInterval = DefaultConfig.PingInterval
+	}
+	if c.PongTimeout == 0 {
+		c.PongTimeout = DefaultConfig.PongTimeout
+	}
+	if c.MaxConns == 0 {
+		c.MaxConns = DefaultConfig.MaxConns
+	}
+	if c.SendQueue.Size == 0 {
+		c.SendQueue.Size = DefaultConfig.SendQueue.Size
+	}
+	if c.ReplayBufferSize == 0 {
+		c.ReplayBufferSize = DefaultConfig.ReplayBufferSize
+	}
+	return c
+}
+
+func (c *Config) Validate() error {
+	if !strings.HasPrefix(c.Path, "/") {
+		return errors.Errorf("invalid path %q: must start with /", c.Path)
+	}
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return errors.Errorf("invalid allowed origin %q: must be scheme://host[:port] or *", origin)
+		}
+	}
+	switch {
+	case c.MaxMessageSize < 0:
+		return errors.New("negative max message size")
+	case c.HandshakeTimeout < 0 || c.WriteTimeout < 0 || c.ReadTimeout < 0:
+		return errors.New("negative timeout")
+	case c.PingInterval < 0 || c.PongTimeout < 0:
+		return errors.New("negative keepalive")
+	case c.ReadTimeout > 0 && c.ReadTimeout <= c.PingInterval:
+		return errors.New("read timeout not above ping interval")
+	case c.SendQueue.Size < 0:
+		return errors.New("negative send queue size")
+	case c.ReplayBufferSize < 0:
+		return errors.New("negative replay buffer size")
+	case c.SendQueue.Policy < PolicyDropOldest || c.SendQueue.Policy > PolicyDisconnect:
+		return errors.Errorf("unknown slow consumer policy %d", c.SendQueue.Policy)
+	}
+	if err := c.TLS.validate(); err != nil {
+		return err
+	}
+	return c.Auth.validate()
+}
+
+// checkOrigin implements websocket.Upgrader.CheckOrigin according to AllowedOrigins
+func (c *Config) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if len(c.AllowedOrigins) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
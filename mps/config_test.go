@@ -0,0 +1,74 @@
+package mps
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		modify func(c *Config)
+		ok     bool
+	}{
+		{func(c *Config) {}, true},
+		{func(c *Config) { c.AllowedOrigins = []string{"*", "https://example.com"} }, true},
+		{func(c *Config) { c.Path = "mps" }, false},
+		{func(c *Config) { c.AllowedOrigins = []string{"example.com"} }, false},
+		{func(c *Config) { c.WriteTimeout = -time.Second }, false},
+		{func(c *Config) { c.MaxConns = -1 }, true},
+		{func(c *Config) { c.PongTimeout = -time.Second }, false},
+		{func(c *Config) { c.ReadTimeout = c.PingInterval + time.Second }, true},
+		{func(c *Config) { c.ReadTimeout = c.PingInterval }, false},
+		{func(c *Config) { c.SendQueue.Policy = 42 }, false},
+		{func(c *Config) { c.TLS = TLSConfig{CertFile: "cert.pem", KeyFile: "key.pem", ClientCAFile: "ca.pem"} }, true},
+		{func(c *Config) { c.TLS = TLSConfig{CertFile: "cert.pem"} }, false},
+		{func(c *Config) { c.TLS = TLSConfig{ClientCAFile: "ca.pem"} }, false},
+	}
+	for i, test := range tests {
+		cfg := DefaultConfig
+		test.modify(&cfg)
+		err := cfg.Validate()
+		if (err == nil) != test.ok {
+			t.Errorf("test %d: err = %v, want ok %v", i, err, test.ok)
+		}
+	}
+}
+
+func TestConfigWithDefaults(t *testing.T) {
+	cfg := Config{ListenAddr: "127.0.0.1:9000", MaxConns: 8}.withDefaults()
+	if cfg.ListenAddr != "127.0.0.1:9000" || cfg.MaxConns != 8 {
+		t.Errorf("set fields overridden: %+v", cfg)
+	}
+	if cfg.Path != DefaultConfig.Path || cfg.WriteTimeout != DefaultConfig.WriteTimeout || cfg.SendQueue.Size != DefaultConfig.SendQueue.Size {
+		t.Errorf("unset fields not defaulted: %+v", cfg)
+	}
+	if cfg := (Config{}).withDefaults(); cfg.MaxConns != DefaultConfig.MaxConns {
+		t.Errorf("max conns = %d, want %d", cfg.MaxConns, DefaultConfig.MaxConns)
+	}
+}
+
+func TestConfigCheckOrigin(t *testing.T) {
+	tests := []struct {
+		allowed []string
+		origin  string
+		ok      bool
+	}{
+		{nil, "", true},
+		{nil, "http://mps.local", true},
+		{nil, "http://evil.com", false},
+		{[]string{"*"}, "http://evil.com", true},
+		{[]string{"https://dash.example.com"}, "https://dash.example.com", true},
+		{[]string{"https://dash.example.com"}, "http://mps.local", false},
+	}
+	for i, test := range tests {
+		cfg := Config{AllowedOrigins: test.allowed}
+		r := httptest.NewRequest("GET", "http://mps.local/", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if ok := cfg.checkOrigin(r); ok != test.ok {
+			t.Errorf("test %d: checkOrigin = %v, want %v", i, ok, test.ok)
+		}
+	}
+}
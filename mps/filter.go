@@ -0,0 +1,103 @@
+package mps
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/pkg/errors"
+)
+
+// txMatcher is the compiled form of a TxFilter, a nil txMatcher matches any tx
+type txMatcher struct {
+	from        map[common.Address]bool
+	to          map[common.Address]bool
+	methods     map[[4]byte]bool
+	minValue    *big.Int
+	minGasPrice *big.Int
+	types       map[uint8]bool
+}
+
+func newTxMatcher(f *TxFilter) (*txMatcher, error) {
+	if f == nil {
+		return nil, nil
+	}
+	m := &txMatcher{
+		minValue:    f.MinValue.ToInt(),
+		minGasPrice: f.MinGasPrice.ToInt(),
+	}
+	if len(f.From) > 0 {
+		m.from = make(map[common.Address]bool, len(f.From))
+		for _, addr := range f.From {
+			m.from[addr] = true
+		}
+	}
+	if len(f.To) > 0 {
+		m.to = make(map[common.Address]bool, len(f.To))
+		for _, addr := range f.To {
+			m.to[addr] = true
+		}
+	}
+	if len(f.Methods) > 0 {
+		m.methods = make(map[[4]byte]bool, len(f.Methods))
+		for _, method := range f.Methods {
+			if len(method) != 4 {
+				return nil, errors.Errorf("invalid method selector %s", method)
+			}
+			m.methods[[4]byte(method)] = true
+		}
+	}
+	if len(f.Types) > 0 {
+		m.types = make(map[uint8]bool, len(f.Types))
+		for _, t := range f.Types {
+			if t > 0xff {
+				return nil, errors.Errorf("invalid tx type %d", t)
+			}
+			m.types[uint8(t)] = true
+		}
+	}
+	return m, nil
+}
+
+func (m *txMatcher) match(tx *types.Transaction, from *common.Address) bool {
+	if m == nil {
+		return true
+	}
+	if m.from != nil && (from == nil || !m.from[*from]) {
+		return false
+	}
+	if m.to != nil && (tx.To() == nil || !m.to[*tx.To()]) {
+		return false
+	}
+	if m.methods != nil {
+		data := tx.Data()
+		if len(data) < 4 || !m.methods[[4]byte(data[:4])] {
+			return false
+		}
+	}
+	if m.types != nil && !m.types[tx.Type()] {
+		return false
+	}
+	if m.minValue != nil && tx.Value().Cmp(m.minValue) < 0 {
+		return false
+	}
+	if m.minGasPrice != nil && tx.GasPrice().Cmp(m.minGasPrice) < 0 {
+		return false
+	}
+	return true
+}
+
+// filter selects the matching txs with their senders
+func (m *txMatcher) filter(txs TxsWithSender) TxsWithSender {
+	if m == nil {
+		return txs
+	}
+	var selected TxsWithSender
+	for i, tx := range txs.Txs {
+		if m.match(tx, txs.Senders[i]) {
+			selected.Txs = append(selected.Txs, tx)
+			selected.Senders = append(selected.Senders, txs.Senders[i])
+		}
+	}
+	return selected
+}
@@ -0,0 +1,64 @@
+package mps
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestTxMatcher(t *testing.T) {
+	token := common.Address{0xaa}
+	sender := common.Address{0xbb}
+	transfer := hexutil.Bytes{0xa9, 0x05, 0x9c, 0xbb}
+	call := types.NewTx(&types.DynamicFeeTx{
+		To:        &token,
+		Value:     big.NewInt(0),
+		GasFeeCap: big.NewInt(100),
+		GasTipCap: big.NewInt(1),
+		Data:      append(transfer, make([]byte, 64)...),
+	})
+	create := types.NewTx(&types.LegacyTx{Value: big.NewInt(10), GasPrice: big.NewInt(50)})
+
+	tests := []struct {
+		filter *TxFilter
+		call   bool
+		create bool
+	}{
+		{nil, true, true},
+		{&TxFilter{}, true, true},
+		{&TxFilter{To: []common.Address{token}}, true, false},
+		{&TxFilter{From: []common.Address{sender}}, true, false},
+		{&TxFilter{Methods: []hexutil.Bytes{transfer}}, true, false},
+		{&TxFilter{MinValue: (*hexutil.Big)(big.NewInt(10))}, false, true},
+		{&TxFilter{MinGasPrice: (*hexutil.Big)(big.NewInt(60))}, true, false},
+		{&TxFilter{Types: []uint64{types.LegacyTxType}}, false, true},
+		{&TxFilter{To: []common.Address{token}, Types: []uint64{types.LegacyTxType}}, false, false},
+	}
+	for i, test := range tests {
+		m, err := newTxMatcher(test.filter)
+		if err != nil {
+			t.Fatalf("test %d: %v", i, err)
+		}
+		if got := m.match(call, &sender); got != test.call {
+			t.Errorf("test %d: call match = %v, want %v", i, got, test.call)
+		}
+		if got := m.match(create, nil); got != test.create {
+			t.Errorf("test %d: create match = %v, want %v", i, got, test.create)
+		}
+	}
+
+	filtered := (&txMatcher{to: map[common.Address]bool{token: true}}).filter(TxsWithSender{
+		Txs:     types.Transactions{create, call},
+		Senders: []*common.Address{nil, &sender},
+	})
+	if len(filtered.Txs) != 1 || filtered.Txs[0] != call || filtered.Senders[0] != &sender {
+		t.Errorf("unexpected filtered txs %v", filtered.Txs)
+	}
+
+	if _, err := newTxMatcher(&TxFilter{Methods: []hexutil.Bytes{{0x01}}}); err == nil {
+		t.Error("expected error on short method selector")
+	}
+}
@@ -0,0 +1,74 @@
+package mps
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+var ErrIncompatibleProtocol = errors.New("incompatible mps protocol")
+
+// NewHello returns the Hello of this build
+func NewHello() *Hello {
+	return &Hello{
+		Version:    ProtocolVersion,
+		MinVersion: MinProtocolVersion,
+		Topics:     slices.Clone(SupportTopics),
+		Encodings:  slices.Clone(SupportEncodings),
+		Features:   slices.Clone(SupportFeatures),
+	}
+}
+
+// Negotiate returns the highest protocol version spoken by both h and peer,
+// the error wraps ErrIncompatibleProtocol if there is none
+func (h *Hello) Negotiate(peer *Hello) (uint, error) {
+	version := min(h.Version, peer.Version)
+	if version < h.MinVersion || version < peer.MinVersion || version == 0 {
+		return 0, errors.Wrapf(ErrIncompatibleProtocol, "local version %d (min %d), peer version %d (min %d)",
+			h.Version, h.MinVersion, peer.Version, peer.MinVersion)
+	}
+	return version, nil
+}
+
+// HasFeature reports whether f is advertised by h
+func (h *Hello) HasFeature(f Feature) bool {
+	return slices.Contains(h.Features, f)
+}
+
+// handshake sends the server Hello and waits for the client's one, the client is told
+// why and the conn is closed with websocket.CloseProtocolError if they are incompatible
+func (r *Remote) handshake() error {
+	hello := NewHello()
+	hello.Epoch = r.srv.epoch
+	data, _ := encodePayload(r.enc, FeedTypeHello, hello)
+	if err := r.write(&FeedPacket{Type: FeedTypeHello, Data: data}); err != nil {
+		return err
+	}
+	r.c.SetReadLimit(r.srv.cfg.MaxMessageSize)
+	r.c.SetReadDeadline(time.Now().Add(r.srv.cfg.HandshakeTimeout))
+	var req RequestPacket
+	if err := r.c.ReadJSON(&req); err != nil {
+		return err
+	}
+	var err error
+	if req.Op != ClientOptHello || req.Hello == nil {
+		err = errors.Wrap(ErrIncompatibleProtocol, "expected hello request")
+	} else {
+		r.version, err = hello.Negotiate(req.Hello)
+	}
+	if err != nil {
+		data, _ = encodePayload(r.enc, FeedTypeResponse, ResponsePacket{req.Id, false, err.Error()})
+		if werr := r.write(&FeedPacket{Type: FeedTypeResponse, Data: data}); werr == nil {
+			msg := websocket.FormatCloseMessage(websocket.CloseProtocolError, "incompatible protocol")
+			r.c.WriteControl(websocket.CloseMessage, msg, time.Now().Add(r.srv.cfg.WriteTimeout))
+		}
+		return err
+	}
+	r.c.SetReadDeadline(time.Time{})
+	r.logger.Debug("handshake done", "remote", r.c.RemoteAddr(), "version", r.version, "features", req.Hello.Features)
+	data, _ = encodePayload(r.enc, FeedTypeResponse, ResponsePacket{req.Id, true, fmt.Sprintf("protocol version %d", r.version)})
+	return r.write(&FeedPacket{Type: FeedTypeResponse, Data: data})
+}
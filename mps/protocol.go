@@ -2,9 +2,18 @@ package mps
 
 import (
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/core/types"
 )
 
+// ProtocolVersion is the version of the MPS protocol spoken by this build, it is bumped
+// on any change of the FeedType numbering or of the packet layout.
+// MinProtocolVersion is the oldest version this build is still compatible with.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
 type FeedType int
 
 const (
@@ -12,8 +21,27 @@ const (
 	FeedTypeTransactions
 	FeedTypeBlockedTxHashes
 	FeedTypeResponse // response to client subscription requests
+	FeedTypeSnapshot
+	FeedTypeDroppedTxs
+	FeedTypeReorg
+	FeedTypeGap
+	FeedTypeHello // first packet of every conn, see Hello
 )
 
+// feedTopics maps the sequenced feed types to their topic
+var feedTopics = map[FeedType]Topic{
+	FeedTypeTransactions:    TopicNewTx,
+	FeedTypeBlockedTxHashes: TopicBlockedTxHashes,
+	FeedTypeDroppedTxs:      TopicDroppedTxs,
+	FeedTypeReorg:           TopicReorg,
+}
+
+// Topic returns the topic of the sequenced feed types, ok is false for the others
+func (t FeedType) Topic() (topic Topic, ok bool) {
+	topic, ok = feedTopics[t]
+	return topic, ok
+}
+
 // TxsWithSender is a wrapper of transactions and their senders,
 // used to send txs packet to mps client
 type TxsWithSender struct {
@@ -21,16 +49,121 @@ type TxsWithSender struct {
 	Senders []*common.Address  `json:"senders"`
 }
 
-// FeedPacket is the packet sent to mps client
+// SnapshotPacket is one chunk of the node's txpool content,
+// streamed to mps client right after it subscribes TopicSnapshot.
+// The last chunk of a snapshot is marked Done.
+type SnapshotPacket struct {
+	Pending TxsWithSender `json:"pending"`
+	Queued  TxsWithSender `json:"queued"`
+	Done    bool          `json:"done"`
+}
+
+// DropReason tells why a tx left the node's txpool
+type DropReason string
+
+const (
+	DropReasonReplaced    DropReason = "replaced"    // replaced by a tx with the same sender and nonce
+	DropReasonEvicted     DropReason = "evicted"     // evicted by the txpool, e.g. underpriced or pool full
+	DropReasonInvalidated DropReason = "invalidated" // nonce consumed by another tx included in a block
+	DropReasonMined       DropReason = "mined"       // included in a block
+)
+
+// DroppedTx announces a tx leaving the node's txpool
+type DroppedTx struct {
+	Hash       common.Hash  `json:"hash"`
+	Reason     DropReason   `json:"reason"`
+	ReplacedBy *common.Hash `json:"replacedBy,omitempty" rlp:"nil"`
+}
+
+// ReorgEvent announces the node switched to another chain. Txs of the orphaned blocks
+// which are not included by the new chain are reinjected as they are pending again,
+// unless the new chain consumed their nonce with another tx, and txs of all the blocks
+// added by the new chain are included.
+type ReorgEvent struct {
+	OldHead    common.Hash   `json:"oldHead"`
+	OldNumber  uint64        `json:"oldNumber"`
+	NewHead    common.Hash   `json:"newHead"`
+	NewNumber  uint64        `json:"newNumber"`
+	Depth      uint64        `json:"depth"` // number of orphaned blocks
+	Reinjected TxsWithSender `json:"reinjected"`
+	Included   []common.Hash `json:"included"`
+}
+
+// GapPacket tells a client resuming a topic that the packets after ResumeFrom
+// are no longer available, the packets from Oldest to Latest are
+type GapPacket struct {
+	Topic      Topic  `json:"topic"`
+	ResumeFrom uint64 `json:"resumeFrom"`
+	Oldest     uint64 `json:"oldest"`
+	Latest     uint64 `json:"latest"`
+}
+
+// Feature is an optional capability of the protocol
+type Feature string
+
+const (
+	FeatureTxFilter Feature = "txFilter" // TxFilter on subscriptions
+	FeatureResume   Feature = "resume"   // sequenced packets and RequestPacket.ResumeFrom
+)
+
+// SupportFeatures are the features implemented by this build
+var SupportFeatures = []Feature{FeatureTxFilter, FeatureResume}
+
+// Hello is exchanged when connecting: the server sends its Hello as the first packet,
+// the client replies with a ClientOptHello request carrying its own, and the server
+// responds with a ResponsePacket. The conn is closed if their versions are incompatible.
+// The payload of the hello packet is always JSON.
+type Hello struct {
+	Version    uint       `json:"version"`
+	MinVersion uint       `json:"minVersion"`
+	Topics     []Topic    `json:"topics"`
+	Encodings  []Encoding `json:"encodings"`
+	Features   []Feature  `json:"features"`
+	// Epoch identifies the server instance, only sent by servers. The seqs of the packets
+	// can only be resumed from on the same epoch, a restarted server has a new one.
+	Epoch string `json:"epoch,omitempty"`
+}
+
+// FeedPacket is the packet sent to mps client.
+// Packets of the sequenced feed types carry a per topic Seq, increasing by one from 1,
+// and the unix milli Time the server received the event.
+// Prev is the Seq of the previous packet of the topic sent to the client, 0 after subscribing
+// without resuming: the seqs between Prev and Seq were filtered out for the client, whereas
+// a Prev other than the last Seq received means packets were lost.
 type FeedPacket struct {
 	Type FeedType `json:"type"`
 	Data []byte   `json:"data"`
+	Seq  uint64   `json:"seq,omitempty"`
+	Time int64    `json:"time,omitempty"`
+	Prev uint64   `json:"prev,omitempty"`
+
+	enc Encoding // encoding the packet was received with, see Decode
 }
 
 type RequestPacket struct {
-	Id    int       `json:"id"`
-	Op    ClientOpt `json:"opt"`
-	Topic Topic     `json:"topic"`
+	Id     int       `json:"id"`
+	Op     ClientOpt `json:"opt"`
+	Topic  Topic     `json:"topic"`
+	Filter *TxFilter `json:"filter,omitempty"` // only for TopicNewTx and TopicSnapshot
+	// ResumeFrom is the seq of the last packet received, the packets after it are replayed
+	// on subscribe, or a FeedTypeGap packet is sent if they are no longer available.
+	// Epoch is the Hello.Epoch of the server ResumeFrom was received from, a Gap is sent
+	// if it's not the current one.
+	ResumeFrom *uint64 `json:"resumeFrom,omitempty"`
+	Epoch      string  `json:"epoch,omitempty"`
+	Hello      *Hello  `json:"hello,omitempty"` // only for ClientOptHello
+}
+
+// TxFilter narrows the txs sent to a subscriber. A tx is sent when it satisfies
+// every non-empty field, a field listing several values matches any of them.
+type TxFilter struct {
+	From    []common.Address `json:"from,omitempty"`
+	To      []common.Address `json:"to,omitempty"`
+	Methods []hexutil.Bytes  `json:"methods,omitempty"` // 4-byte selectors of the call data
+	// MinValue and MinGasPrice are inclusive, the gas price of dynamic fee txs is their fee cap
+	MinValue    *hexutil.Big `json:"minValue,omitempty"`
+	MinGasPrice *hexutil.Big `json:"minGasPrice,omitempty"`
+	Types       []uint64     `json:"types,omitempty"`
 }
 
 type ResponsePacket struct {
@@ -45,6 +178,7 @@ type ClientOpt int
 const (
 	ClientOptSubscribe ClientOpt = iota
 	ClientOptUnsubscribe
+	ClientOptHello
 )
 
 type Topic string
@@ -52,4 +186,10 @@ type Topic string
 const (
 	TopicNewTx           Topic = "newTx"
 	TopicBlockedTxHashes       = "blockedTxHashes"
+	TopicSnapshot              = "snapshot"
+	TopicDroppedTxs            = "droppedTxs"
+	TopicReorg                 = "reorg"
 )
+
+// SupportTopics are the topics served by this build
+var SupportTopics = []Topic{TopicNewTx, TopicBlockedTxHashes, TopicSnapshot, TopicDroppedTxs, TopicReorg}
@@ -0,0 +1,118 @@
+package mps
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var ErrSlowConsumer = errors.New("slow consumer disconnected")
+
+// SlowConsumerPolicy decides what happens to a packet fed to a remote whose send queue is full
+type SlowConsumerPolicy int
+
+const (
+	PolicyDropOldest SlowConsumerPolicy = iota // drop the oldest queued packet to make room
+	PolicyDropNewest                           // drop the packet being fed
+	PolicyDisconnect                           // close the conn of the slow remote
+)
+
+func (p SlowConsumerPolicy) String() string {
+	switch p {
+	case PolicyDropOldest:
+		return "dropOldest"
+	case PolicyDropNewest:
+		return "dropNewest"
+	case PolicyDisconnect:
+		return "disconnect"
+	default:
+		return "unknown"
+	}
+}
+
+// SendQueueConfig bounds the outbound packets queued for each remote
+type SendQueueConfig struct {
+	Size   int
+	Policy SlowConsumerPolicy
+}
+
+var DefaultSendQueueConfig = SendQueueConfig{
+	Size:   256,
+	Policy: PolicyDropOldest,
+}
+
+// sendQueue is a bounded FIFO of packets waiting to be written to a conn, backed by a ring
+type sendQueue struct {
+	lock   sync.Mutex
+	ring   []FeedPacket
+	head   int // index of the oldest packet
+	count  int
+	policy SlowConsumerPolicy
+
+	// notify is signaled whenever a packet is pushed
+	notify chan struct{}
+}
+
+func newSendQueue(cfg SendQueueConfig) *sendQueue {
+	if cfg.Size <= 0 {
+		cfg.Size = DefaultSendQueueConfig.Size
+	}
+	return &sendQueue{
+		ring:   make([]FeedPacket, cfg.Size),
+		policy: cfg.Policy,
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// push queues packet according to the policy, it reports whether a packet was dropped,
+// and returns ErrSlowConsumer if the remote is to be disconnected
+func (q *sendQueue) push(packet FeedPacket) (dropped bool, err error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.count == len(q.ring) {
+		switch q.policy {
+		case PolicyDropNewest:
+			return true, nil
+		case PolicyDisconnect:
+			return false, ErrSlowConsumer
+		default:
+			q.head = (q.head + 1) % len(q.ring)
+			q.count--
+			dropped = true
+		}
+	}
+	q.ring[(q.head+q.count)%len(q.ring)] = packet
+	q.count++
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return dropped, nil
+}
+
+// pop takes the oldest packet, if any
+func (q *sendQueue) pop() (FeedPacket, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.count == 0 {
+		return FeedPacket{}, false
+	}
+	packet := q.ring[q.head]
+	q.ring[q.head] = FeedPacket{}
+	q.head = (q.head + 1) % len(q.ring)
+	q.count--
+	return packet, true
+}
+
+// free is the number of packets which can be pushed without dropping any
+func (q *sendQueue) free() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.ring) - q.count
+}
+
+func (q *sendQueue) len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.count
+}
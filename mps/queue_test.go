@@ -0,0 +1,51 @@
+package mps
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestSendQueuePolicies(t *testing.T) {
+	tests := []struct {
+		policy  SlowConsumerPolicy
+		dropped int
+		err     error
+		want    []FeedType // queued packets after pushing 0..3
+	}{
+		{PolicyDropOldest, 2, nil, []FeedType{2, 3}},
+		{PolicyDropNewest, 2, nil, []FeedType{0, 1}},
+		{PolicyDisconnect, 0, ErrSlowConsumer, []FeedType{0, 1}},
+	}
+	for _, test := range tests {
+		q := newSendQueue(SendQueueConfig{Size: 2, Policy: test.policy})
+		var (
+			dropped int
+			lastErr error
+		)
+		for i := 0; i < 4; i++ {
+			d, err := q.push(FeedPacket{Type: FeedType(i)})
+			if d {
+				dropped++
+			}
+			if err != nil {
+				lastErr = err
+			}
+		}
+		if dropped != test.dropped || !errors.Is(lastErr, test.err) {
+			t.Errorf("%v: dropped = %d err = %v, want %d %v", test.policy, dropped, lastErr, test.dropped, test.err)
+		}
+		if q.len() != len(test.want) {
+			t.Fatalf("%v: len = %d, want %d", test.policy, q.len(), len(test.want))
+		}
+		for _, want := range test.want {
+			packet, ok := q.pop()
+			if !ok || packet.Type != want {
+				t.Errorf("%v: pop = %d %v, want %d", test.policy, packet.Type, ok, want)
+			}
+		}
+		if _, ok := q.pop(); ok {
+			t.Errorf("%v: queue not empty", test.policy)
+		}
+	}
+}
@@ -1,68 +1,89 @@
 package mps
 
 import (
-	"encoding/json"
-	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/params"
 	"github.com/gorilla/websocket"
 	"github.com/moodbase/TxForesight/log"
 	"github.com/pkg/errors"
 	"io"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var ErrConnClosed = errors.New("ws conn closed")
 
-var supportTopics map[Topic]bool
+var (
+	supportTopics  map[Topic]bool
+	topicFeedTypes map[Topic]FeedType
+)
 
 func init() {
-	supportTopics = map[Topic]bool{
-		TopicNewTx:           true,
-		TopicBlockedTxHashes: true,
+	topicFeedTypes = make(map[Topic]FeedType, len(feedTopics))
+	for t, topic := range feedTopics {
+		topicFeedTypes[topic] = t
+	}
+	supportTopics = make(map[Topic]bool, len(SupportTopics))
+	for _, topic := range SupportTopics {
+		supportTopics[topic] = true
 	}
 }
 
 // Remote represents one conn instance
 type Remote struct {
+	srv        *wsServer
 	c          *websocket.Conn
-	subscribed map[Topic]bool
+	enc        Encoding
+	version    uint                 // protocol version negotiated by the handshake
+	subscribed map[Topic]*txMatcher // a nil matcher lets every tx through
+	prev       map[Topic]uint64     // seq of the last packet fed per topic, guarded by wsServer.feedLock
+	subLock    sync.RWMutex
+	allowed    map[Topic]bool // topics granted by auth, nil allows any topic
 
-	feedCh chan struct {
-		packet FeedPacket
-		errCh  chan error
-	}
+	queue     *sendQueue
+	sent      atomic.Uint64
+	dropped   atomic.Uint64
 	stopCh    chan struct{}
 	closeOnce sync.Once
 
 	logger log.Logger
 }
 
-func NewRemote(c *websocket.Conn, logger log.Logger) *Remote {
+func newRemote(srv *wsServer, c *websocket.Conn, allowed map[Topic]bool) *Remote {
 	return &Remote{
+		srv:        srv,
 		c:          c,
-		subscribed: make(map[Topic]bool),
-		feedCh: make(chan struct {
-			packet FeedPacket
-			errCh  chan error
-		}),
-		stopCh: make(chan struct{}),
-		logger: logger,
+		enc:        encodingOf(c.Subprotocol()),
+		allowed:    allowed,
+		subscribed: make(map[Topic]*txMatcher),
+		prev:       make(map[Topic]uint64),
+		queue:      newSendQueue(srv.cfg.SendQueue),
+		stopCh:     make(chan struct{}),
+		logger:     srv.logger,
 	}
 }
 
-// feed put packet into conn
-func (r *Remote) feed(packet FeedPacket) chan error {
-	errCh := make(chan error)
-	r.feedCh <- struct {
-		packet FeedPacket
-		errCh  chan error
-	}{packet, errCh}
-	return errCh
+// feed queues packet to be sent by sendLoop without waiting for the conn,
+// a full queue is handled by the slow consumer policy
+func (r *Remote) feed(packet FeedPacket) error {
+	dropped, err := r.queue.push(packet)
+	if err != nil {
+		r.logger.Warn("disconnecting slow consumer", "remote", r.c.RemoteAddr(), "queued", r.queue.len())
+		r.srv.disconnected.Add(1)
+		r.Stop()
+		return err
+	}
+	if dropped {
+		r.dropped.Add(1)
+		r.srv.dropped.Add(1)
+		r.logger.Debug("send queue full, packet dropped", "remote", r.c.RemoteAddr(), "type", packet.Type)
+	}
+	return nil
 }
 
 func (r *Remote) FeedChainConfig(config *params.ChainConfig) error {
-	data, _ := json.Marshal(config)
-	return <-r.feed(FeedPacket{
+	data, _ := encodePayload(r.enc, FeedTypeChainConfig, config)
+	return r.feed(FeedPacket{
 		Type: FeedTypeChainConfig,
 		Data: data,
 	})
@@ -70,59 +91,198 @@ func (r *Remote) FeedChainConfig(config *params.ChainConfig) error {
 
 // FeedResponse respond to client requests
 func (r *Remote) FeedResponse(id int, ok bool, msg string) error {
-	data, _ := json.Marshal(ResponsePacket{id, ok, msg})
-	return <-r.feed(FeedPacket{
+	data, _ := encodePayload(r.enc, FeedTypeResponse, ResponsePacket{id, ok, msg})
+	return r.feed(FeedPacket{
 		Type: FeedTypeResponse,
 		Data: data,
 	})
 }
 
-// FeedNewTx relay new tx event to clients
-func (r *Remote) FeedNewTx(txsWithSender TxsWithSender) error {
-	data, _ := json.Marshal(txsWithSender)
-	return <-r.feed(FeedPacket{
-		Type: FeedTypeTransactions,
+// feedEntry relay a sequenced entry of topic to clients, filtering the txs by m.
+// encoded caches the unfiltered payload by encoding, so that it's encoded once for every
+// remote of a dispatch, it's nil if there's nothing to share.
+// The caller must hold wsServer.feedLock.
+func (r *Remote) feedEntry(topic Topic, m *txMatcher, e replayEntry, encoded map[Encoding][]byte) error {
+	payload := e.payload
+	if txs, ok := payload.(TxsWithSender); ok {
+		txs = m.filter(txs)
+		if len(txs.Txs) == 0 {
+			return nil
+		}
+		payload = txs
+	}
+	t := topicFeedTypes[topic]
+	data, ok := encoded[r.enc]
+	if !ok || m != nil {
+		var err error
+		if data, err = encodePayload(r.enc, t, payload); err != nil {
+			return err
+		}
+		if encoded != nil && m == nil {
+			encoded[r.enc] = data
+		}
+	}
+	prev := r.prev[topic]
+	r.prev[topic] = e.seq
+	return r.feed(FeedPacket{
+		Type: t,
 		Data: data,
+		Seq:  e.seq,
+		Time: e.time,
+		Prev: prev,
 	})
 }
 
-// FeedBlockedTxHash relay new blocked tx hash to clients
-func (r *Remote) FeedBlockedTxHash(hashes []common.Hash) error {
-	data, _ := json.Marshal(hashes)
-	return <-r.feed(FeedPacket{
-		Type: FeedTypeBlockedTxHashes,
+// FeedGap tells clients the packets they resume from are no longer available
+func (r *Remote) FeedGap(gap GapPacket) error {
+	data, _ := encodePayload(r.enc, FeedTypeGap, gap)
+	return r.feed(FeedPacket{
+		Type: FeedTypeGap,
 		Data: data,
 	})
 }
 
+// FeedSnapshot relay the node's txpool content to clients, chunk by chunk
+func (r *Remote) FeedSnapshot(packets []SnapshotPacket) error {
+	for _, packet := range packets {
+		data, err := encodePayload(r.enc, FeedTypeSnapshot, packet)
+		if err != nil {
+			return err
+		}
+		err = r.feed(FeedPacket{
+			Type: FeedTypeSnapshot,
+			Data: data,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write sends packet right away, only sendLoop and the handshake, which precedes it, write to the conn
+func (r *Remote) write(packet *FeedPacket) error {
+	messageType, data, err := EncodePacket(r.enc, packet)
+	if err != nil {
+		return errors.Wrapf(err, "encode packet type %d", packet.Type)
+	}
+	r.c.SetWriteDeadline(time.Now().Add(r.srv.cfg.WriteTimeout))
+	return r.c.WriteMessage(messageType, data)
+}
+
+// sendLoop writes the queued packets, and pings the client every PingInterval
 func (r *Remote) sendLoop() {
+	ping := time.NewTicker(r.srv.cfg.PingInterval)
+	defer ping.Stop()
 	for {
 		select {
 		case <-r.stopCh:
-			break
-		case m := <-r.feedCh:
-			err := r.c.WriteJSON(m.packet)
-			m.errCh <- err
+			return
+		case <-ping.C:
+			err := r.c.WriteControl(websocket.PingMessage, nil, time.Now().Add(r.srv.cfg.WriteTimeout))
+			if err != nil {
+				r.logger.Warn("ws ping", "err", err, "remote", r.c.RemoteAddr())
+				r.Stop()
+				return
+			}
+			continue
+		case <-r.queue.notify:
+		}
+		for {
+			packet, ok := r.queue.pop()
+			if !ok {
+				break
+			}
+			if err := r.write(&packet); err != nil {
+				r.logger.Warn("ws write", "err", err, "remote", r.c.RemoteAddr())
+				r.Stop()
+				return
+			}
+			r.sent.Add(1)
 		}
 	}
 }
 
-func (r *Remote) onSubscribe(topic Topic, id int) error {
-	if supportTopics[topic] {
-		r.subscribed[topic] = true
-		return r.FeedResponse(id, true, "subscribed topic: "+string(topic))
+// RemoteStats are the send counters of one remote
+type RemoteStats struct {
+	Addr    string `json:"addr"`
+	Queued  int    `json:"queued"`
+	Sent    uint64 `json:"sent"`
+	Dropped uint64 `json:"dropped"`
+}
+
+func (r *Remote) Stats() RemoteStats {
+	return RemoteStats{
+		Addr:    r.c.RemoteAddr().String(),
+		Queued:  r.queue.len(),
+		Sent:    r.sent.Load(),
+		Dropped: r.dropped.Load(),
 	}
-	return r.FeedResponse(id, false, "unknown topic :"+string(topic))
+}
+
+// subscription returns the matcher of topic, ok is false if topic is not subscribed
+func (r *Remote) subscription(topic Topic) (m *txMatcher, ok bool) {
+	r.subLock.RLock()
+	defer r.subLock.RUnlock()
+	m, ok = r.subscribed[topic]
+	return m, ok
+}
+
+func (r *Remote) onSubscribe(topic Topic, filter *TxFilter, resumeFrom *uint64, epoch string, id int) error {
+	if !supportTopics[topic] {
+		return r.FeedResponse(id, false, "unknown topic :"+string(topic))
+	}
+	if r.allowed != nil && !r.allowed[topic] {
+		return r.FeedResponse(id, false, "topic not permitted: "+string(topic))
+	}
+	if filter != nil && topic != TopicNewTx && topic != TopicSnapshot {
+		return r.FeedResponse(id, false, "filter not supported by topic: "+string(topic))
+	}
+	m, err := newTxMatcher(filter)
+	if err != nil {
+		return r.FeedResponse(id, false, "invalid filter: "+err.Error())
+	}
+	err = r.srv.subscribe(r, topic, m, resumeFrom, epoch, id)
+	if err != nil || topic != TopicSnapshot {
+		return err
+	}
+	// snapshot is streamed once per subscription, after the response
+	packets := r.srv.Snapshot()
+	for i := range packets {
+		packets[i].Pending = m.filter(packets[i].Pending)
+		packets[i].Queued = m.filter(packets[i].Queued)
+	}
+	return r.FeedSnapshot(packets)
 }
 
 // onUnsubscribe always respond ok
 func (r *Remote) onUnsubscribe(topic Topic, id int) error {
+	r.subLock.Lock()
 	delete(r.subscribed, topic)
+	r.subLock.Unlock()
 	return r.FeedResponse(id, true, "unsubscribed topic (unchecked): "+string(topic))
 }
 
+// extendReadDeadline expects a pong or a request within PingInterval+PongTimeout,
+// or within ReadTimeout if set and shorter, from the last one received
+func (r *Remote) extendReadDeadline() {
+	cfg := &r.srv.cfg
+	idle := cfg.PingInterval + cfg.PongTimeout
+	if cfg.ReadTimeout > 0 && cfg.ReadTimeout < idle {
+		idle = cfg.ReadTimeout
+	}
+	r.c.SetReadDeadline(time.Now().Add(idle))
+}
+
 func (r *Remote) RecvLoop() error {
+	r.c.SetReadLimit(r.srv.cfg.MaxMessageSize)
+	// a client which stopped answering pings is a dead peer, whose read fails with a timeout
+	r.c.SetPongHandler(func(string) error {
+		r.extendReadDeadline()
+		return nil
+	})
 	for {
+		r.extendReadDeadline()
 		var req RequestPacket
 		err := r.c.ReadJSON(&req)
 		if err != nil {
@@ -137,7 +297,7 @@ func (r *Remote) RecvLoop() error {
 		}
 		switch req.Op {
 		case ClientOptSubscribe:
-			err = r.onSubscribe(req.Topic, req.Id)
+			err = r.onSubscribe(req.Topic, req.Filter, req.ResumeFrom, req.Epoch, req.Id)
 			if err != nil {
 				return err
 			}
@@ -146,6 +306,11 @@ func (r *Remote) RecvLoop() error {
 			if err != nil {
 				return err
 			}
+		case ClientOptHello:
+			err = r.FeedResponse(req.Id, false, "handshake already done")
+			if err != nil {
+				return err
+			}
 		default:
 			r.logger.Error("Announce MPS: unsupported request type", "remote", r.c.RemoteAddr())
 		}
@@ -154,6 +319,10 @@ func (r *Remote) RecvLoop() error {
 
 // Serve blocked until conn closed
 func (r *Remote) Serve(cfg *params.ChainConfig) error {
+	if err := r.handshake(); err != nil {
+		r.Stop()
+		return errors.Wrapf(err, "handshake with %s", r.c.RemoteAddr())
+	}
 	go r.sendLoop()
 	err := r.FeedChainConfig(cfg)
 	if err != nil {
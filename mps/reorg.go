@@ -0,0 +1,89 @@
+package mps
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/pkg/errors"
+)
+
+// maxReorgDepth bounds how far back the chain is walked to find the common ancestor
+const maxReorgDepth = 64
+
+var ErrReorgTooDeep = errors.New("reorg deeper than max depth")
+
+// chainDiff walks back from both heads to their common ancestor, and returns the
+// blocks orphaned from the old chain and the blocks added by the new chain, from head to ancestor.
+// If the new head simply extends the old one, oldChain is empty.
+func chainDiff(bc blockchain, oldHead, newHead *types.Block) (oldChain, newChain []*types.Block, err error) {
+	parent := func(b *types.Block) (*types.Block, error) {
+		if len(oldChain)+len(newChain) > 2*maxReorgDepth {
+			return nil, ErrReorgTooDeep
+		}
+		p := bc.GetBlock(b.ParentHash(), b.NumberU64()-1)
+		if p == nil {
+			return nil, errors.Errorf("missing block %d %s", b.NumberU64()-1, b.ParentHash())
+		}
+		return p, nil
+	}
+	for oldHead.NumberU64() > newHead.NumberU64() {
+		oldChain = append(oldChain, oldHead)
+		if oldHead, err = parent(oldHead); err != nil {
+			return nil, nil, err
+		}
+	}
+	for newHead.NumberU64() > oldHead.NumberU64() {
+		newChain = append(newChain, newHead)
+		if newHead, err = parent(newHead); err != nil {
+			return nil, nil, err
+		}
+	}
+	for oldHead.Hash() != newHead.Hash() {
+		oldChain = append(oldChain, oldHead)
+		newChain = append(newChain, newHead)
+		if oldHead, err = parent(oldHead); err != nil {
+			return nil, nil, err
+		}
+		if newHead, err = parent(newHead); err != nil {
+			return nil, nil, err
+		}
+	}
+	return oldChain, newChain, nil
+}
+
+// newReorgEvent builds the ReorgEvent of a chain switch, txs of the orphaned blocks
+// which are not included by the new chain, and whose nonce the new chain didn't consume,
+// are reinjected with their senders
+func newReorgEvent(signer types.Signer, oldHead, newHead *types.Block, oldChain, newChain []*types.Block) *ReorgEvent {
+	e := &ReorgEvent{
+		OldHead:   oldHead.Hash(),
+		OldNumber: oldHead.NumberU64(),
+		NewHead:   newHead.Hash(),
+		NewNumber: newHead.NumberU64(),
+		Depth:     uint64(len(oldChain)),
+	}
+	included := make(map[common.Hash]bool)
+	nextNonces := make(map[common.Address]uint64) // nonces consumed by the new chain
+	for _, b := range newChain {
+		for _, tx := range b.Transactions() {
+			included[tx.Hash()] = true
+			e.Included = append(e.Included, tx.Hash())
+			if from, err := types.Sender(signer, tx); err == nil && tx.Nonce()+1 > nextNonces[from] {
+				nextNonces[from] = tx.Nonce() + 1
+			}
+		}
+	}
+	for _, b := range oldChain {
+		for _, tx := range b.Transactions() {
+			if included[tx.Hash()] {
+				continue
+			}
+			from, err := types.Sender(signer, tx)
+			if err != nil || tx.Nonce() < nextNonces[from] {
+				continue
+			}
+			e.Reinjected.Txs = append(e.Reinjected.Txs, tx)
+			e.Reinjected.Senders = append(e.Reinjected.Senders, &from)
+		}
+	}
+	return e
+}
@@ -0,0 +1,98 @@
+package mps
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+type testChain struct {
+	blocks map[common.Hash]*types.Block
+	head   *types.Block
+}
+
+func (c *testChain) SubscribeChainHeadEvent(ch chan<- core.ChainHeadEvent) event.Subscription {
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		<-quit
+		return nil
+	})
+}
+
+func (c *testChain) Config() *params.ChainConfig { return params.TestChainConfig }
+
+func (c *testChain) CurrentBlock() *types.Header { return c.head.Header() }
+
+func (c *testChain) GetBlock(hash common.Hash, number uint64) *types.Block {
+	b := c.blocks[hash]
+	if b == nil || b.NumberU64() != number {
+		return nil
+	}
+	return b
+}
+
+// extend appends a block on top of parent, fork differentiates sibling blocks
+func (c *testChain) extend(parent *types.Block, fork byte, txs ...*types.Transaction) *types.Block {
+	b := types.NewBlockWithHeader(&types.Header{
+		ParentHash: parent.Hash(),
+		Number:     new(big.Int).Add(parent.Number(), common.Big1),
+		Extra:      []byte{fork},
+	}).WithBody(types.Body{Transactions: txs})
+	c.blocks[b.Hash()] = b
+	return b
+}
+
+func TestChainDiff(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	tx0, tx1, tx2, tx3 := signedTx(t, key, 0), signedTx(t, key, 1), signedTx(t, key, 2), signedTx(t, key, 3)
+	// the new chain mines a replacement of tx2 instead
+	bump, err := types.SignTx(types.NewTransaction(2, common.Address{0x01}, big.NewInt(1), 21000, big.NewInt(2), nil),
+		types.LatestSigner(params.TestChainConfig), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	genesis := types.NewBlockWithHeader(&types.Header{Number: common.Big0})
+	c := &testChain{blocks: map[common.Hash]*types.Block{genesis.Hash(): genesis}}
+	a1 := c.extend(genesis, 'a', tx0)
+	a2 := c.extend(a1, 'a', tx1, tx2, tx3)
+	b1 := c.extend(genesis, 'b', tx0)
+	b2 := c.extend(b1, 'b')
+	b3 := c.extend(b2, 'b', tx1, bump)
+
+	oldChain, newChain, err := chainDiff(c, a2, b3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(oldChain) != 2 || len(newChain) != 3 {
+		t.Fatalf("diff = %d/%d blocks, want 2/3", len(oldChain), len(newChain))
+	}
+	e := newReorgEvent(types.LatestSigner(params.TestChainConfig), a2, b3, oldChain, newChain)
+	if e.Depth != 2 || e.OldNumber != 2 || e.NewNumber != 3 {
+		t.Errorf("unexpected reorg %+v", e)
+	}
+	// tx2 is left out as its nonce is consumed by the bump
+	if len(e.Reinjected.Txs) != 1 || e.Reinjected.Txs[0].Hash() != tx3.Hash() {
+		t.Errorf("reinjected = %v, want [%v]", e.Reinjected.Txs, tx3.Hash())
+	}
+	if *e.Reinjected.Senders[0] != crypto.PubkeyToAddress(key.PublicKey) {
+		t.Errorf("sender = %v, want %v", e.Reinjected.Senders[0], crypto.PubkeyToAddress(key.PublicKey))
+	}
+	if len(e.Included) != 3 {
+		t.Errorf("included = %v, want 3 txs", e.Included)
+	}
+
+	// a plain extension has nothing orphaned
+	oldChain, newChain, err = chainDiff(c, b1, b3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(oldChain) != 0 || len(newChain) != 2 {
+		t.Errorf("diff = %d/%d blocks, want 0/2", len(oldChain), len(newChain))
+	}
+}
@@ -0,0 +1,57 @@
+package mps
+
+import "time"
+
+// replayEntry is a sequenced payload of a topic, kept before any per remote filter is applied
+type replayEntry struct {
+	seq     uint64
+	time    int64 // unix milli
+	payload any
+}
+
+// replayBuffer numbers the payloads of one topic and keeps the latest ones in a ring,
+// so that a reconnecting client can resume right after the last packet it received.
+// It is guarded by wsServer.feedLock.
+type replayBuffer struct {
+	ring  []replayEntry
+	head  int // index of the oldest entry
+	count int
+	seq   uint64 // seq of the latest entry, the first entry is 1
+}
+
+func newReplayBuffer(size int) *replayBuffer {
+	return &replayBuffer{ring: make([]replayEntry, size)}
+}
+
+// append numbers payload with the next seq and keeps it, evicting the oldest entry when full
+func (b *replayBuffer) append(payload any) replayEntry {
+	b.seq++
+	e := replayEntry{seq: b.seq, time: time.Now().UnixMilli(), payload: payload}
+	if len(b.ring) == 0 {
+		return e
+	}
+	if b.count == len(b.ring) {
+		b.head = (b.head + 1) % len(b.ring)
+		b.count--
+	}
+	b.ring[(b.head+b.count)%len(b.ring)] = e
+	b.count++
+	return e
+}
+
+// oldest is the seq of the oldest kept entry, or the next seq if nothing is kept
+func (b *replayBuffer) oldest() uint64 {
+	return b.seq - uint64(b.count) + 1
+}
+
+// since returns the entries after seq, ok is false if some of them are no longer kept,
+// or if seq was never issued, e.g. the server restarted since
+func (b *replayBuffer) since(seq uint64) (entries []replayEntry, ok bool) {
+	if seq > b.seq || seq+1 < b.oldest() {
+		return nil, false
+	}
+	for i := int(seq + 1 - b.oldest()); i < b.count; i++ {
+		entries = append(entries, b.ring[(b.head+i)%len(b.ring)])
+	}
+	return entries, true
+}
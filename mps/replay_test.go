@@ -0,0 +1,42 @@
+package mps
+
+import "testing"
+
+func TestReplayBuffer(t *testing.T) {
+	b := newReplayBuffer(3)
+	if _, ok := b.since(0); !ok {
+		t.Error("empty buffer should resume from 0")
+	}
+	for i := 1; i <= 5; i++ {
+		if e := b.append(i); e.seq != uint64(i) {
+			t.Fatalf("seq = %d, want %d", e.seq, i)
+		}
+	}
+	tests := []struct {
+		from uint64
+		ok   bool
+		want []uint64
+	}{
+		{0, false, nil},
+		{1, false, nil},
+		{2, true, []uint64{3, 4, 5}},
+		{4, true, []uint64{5}},
+		{5, true, nil},
+		{6, false, nil},
+	}
+	for _, test := range tests {
+		entries, ok := b.since(test.from)
+		if ok != test.ok || len(entries) != len(test.want) {
+			t.Errorf("since(%d) = %d entries %v, want %v %v", test.from, len(entries), ok, test.want, test.ok)
+			continue
+		}
+		for i, e := range entries {
+			if e.seq != test.want[i] || e.payload != int(test.want[i]) {
+				t.Errorf("since(%d)[%d] = %d %v, want %d", test.from, i, e.seq, e.payload, test.want[i])
+			}
+		}
+	}
+	if b.oldest() != 3 {
+		t.Errorf("oldest = %d, want 3", b.oldest())
+	}
+}
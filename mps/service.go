@@ -1,24 +1,33 @@
 package mps
 
 import (
+	"net/http"
+
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/params"
+	"github.com/pkg/errors"
 
 	"github.com/moodbase/TxForesight/log"
 )
 
-type txSub interface {
+type txPool interface {
 	SubscribeTransactions(ch chan<- core.NewTxsEvent, reorgs bool) event.Subscription
+	Content() (map[common.Address][]*types.Transaction, map[common.Address][]*types.Transaction)
+	Has(hash common.Hash) bool
 }
 type blockchain interface {
 	SubscribeChainHeadEvent(ch chan<- core.ChainHeadEvent) event.Subscription
 	Config() *params.ChainConfig
+	CurrentBlock() *types.Header
+	GetBlock(hash common.Hash, number uint64) *types.Block
 }
 
 // MPS (Message Pushing Service) is designed to be used as a service embedded into go-ethereum.
 type MPS struct {
-	pool txSub
+	pool txPool
 	bc   blockchain
 
 	txch            chan core.NewTxsEvent
@@ -27,11 +36,28 @@ type MPS struct {
 	txSubscription  event.Subscription
 	blkSubscription event.Subscription
 
-	ws     *wsServer
-	logger log.Logger
+	ws      *wsServer
+	signer  types.Signer
+	tracker *dropTracker
+	head    *types.Block // last chain head seen by loop
+	logger  log.Logger
 }
 
-func New(pool txSub, bc blockchain, logger log.Logger) *MPS {
+// New creates the MPS service, a nil cfg uses DefaultConfig,
+// unset fields of cfg are taken from DefaultConfig too, except ReadTimeout which is unset by default
+func New(pool txPool, bc blockchain, cfg *Config, logger log.Logger) (*MPS, error) {
+	if cfg == nil {
+		cfg = &DefaultConfig
+	}
+	wsCfg := cfg.withDefaults()
+	if err := wsCfg.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid mps config")
+	}
+	ws, err := newWS(wsCfg, logger, bc.Config(), pool)
+	if err != nil {
+		return nil, err
+	}
+	signer := types.LatestSigner(bc.Config())
 	as := &MPS{
 		pool: pool,
 		bc:   bc,
@@ -40,10 +66,12 @@ func New(pool txSub, bc blockchain, logger log.Logger) *MPS {
 		blkch: make(chan core.ChainHeadEvent),
 		stop:  make(chan struct{}),
 
-		ws:     newWS(":7856", logger, bc.Config()),
-		logger: logger,
+		ws:      ws,
+		signer:  signer,
+		tracker: newDropTracker(signer),
+		logger:  logger,
 	}
-	return as
+	return as, nil
 }
 
 func (s *MPS) subscribeEvents() {
@@ -55,25 +83,94 @@ func (s *MPS) unSubscribeEvents() {
 	s.blkSubscription.Unsubscribe()
 }
 
-func (s *MPS) listen() error {
-	return s.ws.ListenAndServe()
+func (s *MPS) listen() {
+	err := s.ws.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.logger.Error("mps listen", "err", err)
+	}
+}
+
+// seedTracker tracks the txs already in the txpool when MPS starts
+func (s *MPS) seedTracker() {
+	pending, queued := s.pool.Content()
+	for _, content := range []map[common.Address][]*types.Transaction{pending, queued} {
+		for from, txs := range content {
+			for _, tx := range txs {
+				s.tracker.add(tx, from)
+			}
+		}
+	}
+}
+
+func (s *MPS) dispatchDropped(dropped []DroppedTx) {
+	if len(dropped) == 0 {
+		return
+	}
+	s.logger.Debug("dropped txs", "len", len(dropped))
+	s.ws.DispatchDroppedTxs(dropped)
+}
+
+// onChainHead dispatches the txs mined by the new head, and the reorg if the node switched chain
+func (s *MPS) onChainHead(head *types.Block) {
+	newChain := []*types.Block{head}
+	if s.head != nil && head.ParentHash() != s.head.Hash() {
+		// either a reorg or several blocks inserted at once
+		oldChain, chain, err := chainDiff(s.bc, s.head, head)
+		if err != nil {
+			s.logger.Error("failed to diff chain", "old", s.head.Hash(), "new", head.Hash(), "err", err)
+		} else {
+			newChain = chain
+			if len(oldChain) > 0 {
+				e := newReorgEvent(s.signer, s.head, head, oldChain, newChain)
+				s.logger.Info("chain reorg", "old", e.OldNumber, "new", e.NewNumber, "depth", e.Depth,
+					"reinjected", len(e.Reinjected.Txs), "included", len(e.Included))
+				s.ws.DispatchReorg(e)
+			}
+		}
+	}
+	s.head = head
+
+	var (
+		hashes  []common.Hash
+		dropped []DroppedTx
+	)
+	// from the oldest block to the head, so that the nonces are consumed in order
+	for i := len(newChain) - 1; i >= 0; i-- {
+		txs := newChain[i].Transactions()
+		for _, tx := range txs {
+			hashes = append(hashes, tx.Hash())
+		}
+		dropped = append(dropped, s.tracker.block(txs)...)
+	}
+	s.ws.DispatchBlockedTxHashes(hashes)
+	s.dispatchDropped(append(dropped, s.tracker.sweep(s.pool.Has)...))
 }
 
 func (s *MPS) loop() {
+	s.seedTracker()
+	if h := s.bc.CurrentBlock(); h != nil {
+		s.head = s.bc.GetBlock(h.Hash(), h.Number.Uint64())
+	}
 	for {
 		select {
 		case txe := <-s.txch:
 			s.logger.Debug("new txs", "len", len(txe.Txs))
 			s.ws.DispatchNewTxsEvent(txe)
+			s.dispatchDropped(s.tracker.addTxs(txe.Txs))
 		case blke := <-s.blkch:
 			s.logger.Debug("new blocks", "tx len", len(blke.Block.Transactions()))
-			s.ws.DispatchChainHeadEvent(blke)
+			s.onChainHead(blke.Block)
 		case <-s.stop:
 			return
 		}
 	}
 }
 
+// Stats reports the send counters of connected clients
+func (s *MPS) Stats() Stats {
+	return s.ws.Stats()
+}
+
 func (s *MPS) Start() error {
 	s.logger.Debug("### start mps server ###")
 	s.subscribeEvents()
@@ -0,0 +1,59 @@
+package mps
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// TLSConfig serves MPS over wss:// when CertFile and KeyFile are set,
+// setting ClientCAFile additionally requires clients to present a certificate signed by it
+type TLSConfig struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+}
+
+func (c *TLSConfig) enabled() bool {
+	return c.CertFile != ""
+}
+
+func (c *TLSConfig) validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("tls cert and key must be set together")
+	}
+	if c.ClientCAFile != "" && c.CertFile == "" {
+		return errors.New("tls client ca requires a server cert")
+	}
+	return nil
+}
+
+// load reads the cert, key and client ca files, it returns nil if tls is disabled
+func (c *TLSConfig) load() (*tls.Config, error) {
+	if !c.enabled() {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "load tls key pair")
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.ClientCAFile != "" {
+		pem, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "load tls client ca")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificate found in %s", c.ClientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
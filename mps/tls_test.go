@@ -0,0 +1,128 @@
+package mps
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/gorilla/websocket"
+)
+
+// testCert is a certificate signed by its parent, self-signed without one
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write writes the cert and key PEM files into dir, and returns their paths
+func (c *testCert) write(t *testing.T, dir string) (certFile, keyFile string) {
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := c.cert.Subject.CommonName
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestWSServerClientCA(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil)
+	caFile, _ := ca.write(t, dir)
+	certFile, keyFile := newTestCert(t, "mps", ca).write(t, dir)
+
+	cfg := DefaultConfig
+	cfg.TLS = TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile}
+	wss, err := newWS(cfg, log.New(), params.TestChainConfig, &testPool{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(wss)
+	srv.TLS = wss.srv.TLSConfig
+	srv.StartTLS()
+	defer srv.Close()
+	url := "wss" + strings.TrimPrefix(srv.URL, "https")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	dial := func(certs ...tls.Certificate) (*websocket.Conn, error) {
+		dialer := websocket.Dialer{
+			TLSClientConfig:  &tls.Config{RootCAs: roots, Certificates: certs},
+			HandshakeTimeout: time.Second,
+		}
+		c, _, err := dialer.Dial(url, nil)
+		return c, err
+	}
+
+	if c, err := dial(); err == nil {
+		c.Close()
+		t.Error("client without certificate connected")
+	}
+	if c, err := dial(newTestCert(t, "stranger", newTestCert(t, "other-ca", nil)).tlsCertificate()); err == nil {
+		c.Close()
+		t.Error("client with a certificate of another ca connected")
+	}
+	c, err := dial(newTestCert(t, "client", ca).tlsCertificate())
+	if err != nil {
+		t.Fatalf("client with a certificate of the ca: %v", err)
+	}
+	defer c.Close()
+	handshake(t, c)
+}
@@ -0,0 +1,114 @@
+package mps
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+type trackedTx struct {
+	from  common.Address
+	nonce uint64
+}
+
+// dropTracker follows the txs known to be in the node's txpool and tells
+// why they leave it. The txpool doesn't announce drops, so they are inferred:
+// a new tx taking the nonce of a known one replaces it, a block mines known txs
+// and invalidates the ones with a consumed nonce, and a known tx the txpool no
+// longer holds after a block was evicted.
+//
+// dropTracker is not thread safe, it is driven by the MPS event loop only.
+type dropTracker struct {
+	signer types.Signer
+	txs    map[common.Hash]trackedTx
+	slots  map[common.Address]map[uint64]common.Hash
+}
+
+func newDropTracker(signer types.Signer) *dropTracker {
+	return &dropTracker{
+		signer: signer,
+		txs:    make(map[common.Hash]trackedTx),
+		slots:  make(map[common.Address]map[uint64]common.Hash),
+	}
+}
+
+// add tracks tx, the tx previously holding the same sender and nonce is reported as replaced
+func (t *dropTracker) add(tx *types.Transaction, from common.Address) []DroppedTx {
+	hash := tx.Hash()
+	if _, ok := t.txs[hash]; ok {
+		return nil
+	}
+	var dropped []DroppedTx
+	nonces := t.slots[from]
+	if nonces == nil {
+		nonces = make(map[uint64]common.Hash)
+		t.slots[from] = nonces
+	}
+	if old, ok := nonces[tx.Nonce()]; ok {
+		delete(t.txs, old)
+		dropped = append(dropped, DroppedTx{Hash: old, Reason: DropReasonReplaced, ReplacedBy: &hash})
+	}
+	nonces[tx.Nonce()] = hash
+	t.txs[hash] = trackedTx{from, tx.Nonce()}
+	return dropped
+}
+
+func (t *dropTracker) remove(hash common.Hash) {
+	tracked, ok := t.txs[hash]
+	if !ok {
+		return
+	}
+	delete(t.txs, hash)
+	nonces := t.slots[tracked.from]
+	delete(nonces, tracked.nonce)
+	if len(nonces) == 0 {
+		delete(t.slots, tracked.from)
+	}
+}
+
+// addTxs tracks a batch of new txs
+func (t *dropTracker) addTxs(txs types.Transactions) []DroppedTx {
+	var dropped []DroppedTx
+	for _, tx := range txs {
+		from, err := types.Sender(t.signer, tx)
+		if err != nil {
+			continue
+		}
+		dropped = append(dropped, t.add(tx, from)...)
+	}
+	return dropped
+}
+
+// block reports the known txs mined by a block, and the known txs whose nonce is consumed by it
+func (t *dropTracker) block(txs types.Transactions) []DroppedTx {
+	var dropped []DroppedTx
+	for _, tx := range txs {
+		hash := tx.Hash()
+		if _, ok := t.txs[hash]; ok {
+			t.remove(hash)
+			dropped = append(dropped, DroppedTx{Hash: hash, Reason: DropReasonMined})
+		}
+		from, err := types.Sender(t.signer, tx)
+		if err != nil {
+			continue
+		}
+		for nonce, stale := range t.slots[from] {
+			if nonce <= tx.Nonce() {
+				t.remove(stale)
+				dropped = append(dropped, DroppedTx{Hash: stale, Reason: DropReasonInvalidated})
+			}
+		}
+	}
+	return dropped
+}
+
+// sweep reports the known txs which are no longer held by the txpool
+func (t *dropTracker) sweep(has func(hash common.Hash) bool) []DroppedTx {
+	var dropped []DroppedTx
+	for hash := range t.txs {
+		if !has(hash) {
+			t.remove(hash)
+			dropped = append(dropped, DroppedTx{Hash: hash, Reason: DropReasonEvicted})
+		}
+	}
+	return dropped
+}
@@ -0,0 +1,56 @@
+package mps
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+func TestDropTracker(t *testing.T) {
+	signer := types.LatestSigner(params.TestChainConfig)
+	key, _ := crypto.GenerateKey()
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	tr := newDropTracker(signer)
+
+	tx0, tx1, tx2, tx3 := signedTx(t, key, 0), signedTx(t, key, 1), signedTx(t, key, 2), signedTx(t, key, 3)
+	if dropped := tr.addTxs(types.Transactions{tx0, tx1, tx2, tx3}); len(dropped) != 0 {
+		t.Fatalf("unexpected drops %v", dropped)
+	}
+
+	bump, err := types.SignTx(types.NewTransaction(1, common.Address{0x01}, big.NewInt(1), 21000, big.NewInt(2), nil), signer, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dropped := tr.add(bump, from)
+	if len(dropped) != 1 || dropped[0].Hash != tx1.Hash() || dropped[0].Reason != DropReasonReplaced || *dropped[0].ReplacedBy != bump.Hash() {
+		t.Fatalf("replace: unexpected drops %+v", dropped)
+	}
+
+	// a block mining tx0 and an unknown tx with nonce 1 invalidates the bump
+	other, err := types.SignTx(types.NewTransaction(1, common.Address{0x02}, big.NewInt(1), 21000, big.NewInt(3), nil), signer, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dropped = tr.block(types.Transactions{tx0, other})
+	want := map[common.Hash]DropReason{tx0.Hash(): DropReasonMined, bump.Hash(): DropReasonInvalidated}
+	if len(dropped) != len(want) {
+		t.Fatalf("block: unexpected drops %+v", dropped)
+	}
+	for _, d := range dropped {
+		if want[d.Hash] != d.Reason {
+			t.Errorf("block: %v reason = %s, want %s", d.Hash, d.Reason, want[d.Hash])
+		}
+	}
+
+	dropped = tr.sweep(func(hash common.Hash) bool { return hash == tx2.Hash() })
+	if len(dropped) != 1 || dropped[0].Hash != tx3.Hash() || dropped[0].Reason != DropReasonEvicted {
+		t.Fatalf("sweep: unexpected drops %+v", dropped)
+	}
+	if len(tr.txs) != 1 || len(tr.slots[from]) != 1 {
+		t.Errorf("tracked = %d/%d, want 1/1", len(tr.txs), len(tr.slots[from]))
+	}
+}
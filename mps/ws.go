@@ -2,6 +2,8 @@ package mps
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core"
@@ -11,93 +13,265 @@ import (
 	"github.com/moodbase/TxForesight/log"
 	"net/http"
 	"sync"
+	"sync/atomic"
 )
 
-var upgrader = websocket.Upgrader{}
-
 type wsServer struct {
+	cfg      Config
+	upgrader websocket.Upgrader
 	srv      *http.Server
 	conns    map[string]*Remote
 	connLock sync.RWMutex
+	slots    atomic.Int64 // conns accepted, reserved before the upgrade against MaxConns
 
 	logger log.Logger
 
 	chainConfig *params.ChainConfig
 	signer      types.Signer
+	pool        txPool
+
+	// feedLock serializes the dispatch of sequenced packets and the replays
+	feedLock sync.Mutex
+	replay   map[Topic]*replayBuffer
+	epoch    string // Hello.Epoch, the seqs of replay are only valid within it
+
+	dropped      atomic.Uint64 // packets dropped by all remotes
+	disconnected atomic.Uint64 // remotes disconnected for being slow
 }
 
-func newWS(addr string, logger log.Logger, chainConfig *params.ChainConfig) *wsServer {
+func newWS(cfg Config, logger log.Logger, chainConfig *params.ChainConfig, pool txPool) (*wsServer, error) {
+	tlsConfig, err := cfg.TLS.load()
+	if err != nil {
+		return nil, err
+	}
 	w := &wsServer{
+		cfg: cfg,
+		upgrader: websocket.Upgrader{
+			HandshakeTimeout: cfg.HandshakeTimeout,
+			CheckOrigin:      cfg.checkOrigin,
+			Subprotocols:     make([]string, len(SupportEncodings)),
+		},
 		conns:       make(map[string]*Remote),
 		logger:      logger,
 		chainConfig: chainConfig,
 		signer:      types.LatestSigner(chainConfig),
+		pool:        pool,
+		replay:      make(map[Topic]*replayBuffer),
+		epoch:       newEpoch(),
+	}
+	for i, enc := range SupportEncodings {
+		w.upgrader.Subprotocols[i] = string(enc)
+	}
+	for _, topic := range feedTopics {
+		w.replay[topic] = newReplayBuffer(cfg.ReplayBufferSize)
 	}
 	srv := &http.Server{
-		Addr:    addr,
-		Handler: w,
+		Addr:              cfg.ListenAddr,
+		Handler:           w,
+		ReadHeaderTimeout: cfg.HandshakeTimeout,
+		TLSConfig:         tlsConfig,
 	}
 	w.srv = srv
-	return w
+	return w, nil
 }
 
+// DispatchNewTxsEvent sends the txs with their senders, the txs whose sender
+// can't be recovered are left out so that every tx is sent with its sender
 func (s *wsServer) DispatchNewTxsEvent(e core.NewTxsEvent) {
-	s.connLock.RLock()
-	defer s.connLock.RUnlock()
-	senders := make([]*common.Address, len(e.Txs))
-	for i, tx := range e.Txs {
+	txs := TxsWithSender{
+		Txs:     make(types.Transactions, 0, len(e.Txs)),
+		Senders: make([]*common.Address, 0, len(e.Txs)),
+	}
+	for _, tx := range e.Txs {
 		from, err := types.Sender(s.signer, tx)
 		if err != nil {
-			s.logger.Error("tx sender parse error:", err)
+			s.logger.Error("tx sender parse error", "hash", tx.Hash(), "err", err)
 			continue
 		}
-		senders[i] = &from
+		txs.Txs = append(txs.Txs, tx)
+		txs.Senders = append(txs.Senders, &from)
 	}
+	if len(txs.Txs) == 0 {
+		return
+	}
+	s.dispatch(TopicNewTx, txs)
+}
+
+func (s *wsServer) DispatchBlockedTxHashes(hashes []common.Hash) {
+	s.dispatch(TopicBlockedTxHashes, hashes)
+}
+
+func (s *wsServer) DispatchDroppedTxs(dropped []DroppedTx) {
+	s.dispatch(TopicDroppedTxs, dropped)
+}
+
+func (s *wsServer) DispatchReorg(e *ReorgEvent) {
+	s.dispatch(TopicReorg, e)
+}
+
+// dispatch numbers payload in the replay buffer of topic, and feeds it to the subscribers,
+// encoding it once per encoding for the ones without a filter
+func (s *wsServer) dispatch(topic Topic, payload any) {
+	s.feedLock.Lock()
+	defer s.feedLock.Unlock()
+	entry := s.replay[topic].append(payload)
+	encoded := make(map[Encoding][]byte, len(SupportEncodings))
+	s.connLock.RLock()
+	defer s.connLock.RUnlock()
 	for addr, conn := range s.conns {
-		if !conn.subscribed[TopicNewTx] {
+		m, ok := conn.subscription(topic)
+		if !ok {
 			continue
 		}
-		err := conn.FeedNewTx(TxsWithSender{e.Txs, senders})
+		err := conn.feedEntry(topic, m, entry, encoded)
 		if err != nil {
 			s.logger.Error(err.Error(), "addr", addr)
 		}
 	}
 }
 
-func (s *wsServer) DispatchChainHeadEvent(e core.ChainHeadEvent) {
-	s.connLock.RLock()
-	defer s.connLock.RUnlock()
-	hashes := make([]common.Hash, len(e.Block.Transactions()))
-	for i, tx := range e.Block.Transactions() {
-		hashes[i] = tx.Hash()
+// newEpoch returns a random server epoch
+func newEpoch() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// subscribe registers the subscription of r to topic, and replays the packets after resumeFrom if any.
+// resumeFrom is only valid within epoch, the epoch of clients predating it is empty and trusted.
+// It holds feedLock so that no packet is dispatched between the replay and the subscription.
+func (s *wsServer) subscribe(r *Remote, topic Topic, m *txMatcher, resumeFrom *uint64, epoch string, id int) error {
+	s.feedLock.Lock()
+	defer s.feedLock.Unlock()
+	r.subLock.Lock()
+	r.subscribed[topic] = m
+	r.subLock.Unlock()
+	delete(r.prev, topic)
+	err := r.FeedResponse(id, true, "subscribed topic: "+string(topic))
+	replay := s.replay[topic]
+	if err != nil || resumeFrom == nil || replay == nil {
+		return err
 	}
-	for addr, conn := range s.conns {
-		if !conn.subscribed[TopicBlockedTxHashes] {
-			continue
+	entries, ok := replay.since(*resumeFrom)
+	if epoch != "" && epoch != s.epoch {
+		// the seqs of another server instance, e.g. before a restart
+		ok = false
+	}
+	if !ok || len(entries) > r.queue.free() {
+		s.logger.Info("resume gap", "topic", topic, "from", *resumeFrom, "epoch", epoch, "oldest", replay.oldest(), "remote", r.c.RemoteAddr())
+		return r.FeedGap(GapPacket{
+			Topic:      topic,
+			ResumeFrom: *resumeFrom,
+			Oldest:     replay.oldest(),
+			Latest:     replay.seq,
+		})
+	}
+	r.prev[topic] = *resumeFrom
+	for _, e := range entries {
+		if err := r.feedEntry(topic, m, e, nil); err != nil {
+			return err
 		}
-		err := conn.FeedBlockedTxHash(hashes)
-		if err != nil {
-			s.logger.Error(err.Error(), "addr", addr)
+	}
+	return nil
+}
+
+// snapshotChunkSize is the max number of txs carried by one SnapshotPacket
+const snapshotChunkSize = 1024
+
+// Snapshot splits the current content of the node's txpool into SnapshotPackets
+func (s *wsServer) Snapshot() []SnapshotPacket {
+	pending, queued := s.pool.Content()
+	var (
+		packets []SnapshotPacket
+		chunk   SnapshotPacket
+		size    int
+	)
+	add := func(part *TxsWithSender, from common.Address, tx *types.Transaction) {
+		if size == snapshotChunkSize {
+			packets = append(packets, chunk)
+			chunk, size = SnapshotPacket{}, 0
+		}
+		part.Txs = append(part.Txs, tx)
+		part.Senders = append(part.Senders, &from)
+		size++
+	}
+	for from, txs := range pending {
+		for _, tx := range txs {
+			add(&chunk.Pending, from, tx)
+		}
+	}
+	for from, txs := range queued {
+		for _, tx := range txs {
+			add(&chunk.Queued, from, tx)
 		}
 	}
+	chunk.Done = true
+	return append(packets, chunk)
 }
 
 func (s *wsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	c, err := upgrader.Upgrade(w, r, nil)
+	if r.URL.Path != s.cfg.Path {
+		http.NotFound(w, r)
+		return
+	}
+	if !s.reserveSlot() {
+		s.logger.Warn("wsServer max conns reached, rejecting", "remote", r.RemoteAddr, "max", s.cfg.MaxConns)
+		http.Error(w, "too many connections", http.StatusServiceUnavailable)
+		return
+	}
+	var allowed map[Topic]bool
+	if s.cfg.Auth.enabled() {
+		var err error
+		if allowed, err = s.cfg.Auth.authenticate(r); err != nil {
+			s.slots.Add(-1)
+			s.logger.Warn("wsServer auth", "err", err, "remote", r.RemoteAddr)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+	c, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		s.logger.Error("wsServer upgrade:", err)
+		s.slots.Add(-1)
+		// the upgrader has already replied with an http error
+		s.logger.Error("wsServer upgrade", "err", err, "remote", r.RemoteAddr)
+		return
 	}
-	s.logger.Info("new conn:", "addr", c.RemoteAddr())
-	conn := NewRemote(c, s.logger)
+	s.logger.Info("new conn:", "addr", c.RemoteAddr(), "encoding", encodingOf(c.Subprotocol()))
+	conn := newRemote(s, c, allowed)
 	s.AddConn(conn)
 }
 
+// reserveSlot takes a conn slot unless MaxConns are already taken,
+// the slot is released once the conn is served or rejected
+func (s *wsServer) reserveSlot() bool {
+	if s.cfg.MaxConns < 0 {
+		s.slots.Add(1)
+		return true
+	}
+	for {
+		n := s.slots.Load()
+		if n >= int64(s.cfg.MaxConns) {
+			return false
+		}
+		if s.slots.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+func (s *wsServer) connCount() int {
+	s.connLock.RLock()
+	defer s.connLock.RUnlock()
+	return len(s.conns)
+}
+
 func (s *wsServer) AddConn(r *Remote) {
 	s.connLock.Lock()
 	defer s.connLock.Unlock()
 	s.conns[r.c.RemoteAddr().String()] = r
 
 	go func() {
+		defer s.slots.Add(-1)
 		err := r.Serve(s.chainConfig)
 		if err != nil {
 			if !errors.Is(err, ErrConnClosed) {
@@ -122,7 +296,32 @@ func (s *wsServer) RemoveConn(conn *Remote, closeConn bool) {
 	delete(s.conns, conn.c.RemoteAddr().String())
 }
 
+// Stats are the send counters of the MPS websocket server
+type Stats struct {
+	Remotes          []RemoteStats `json:"remotes"`
+	Dropped          uint64        `json:"dropped"`
+	SlowDisconnected uint64        `json:"slowDisconnected"`
+}
+
+func (s *wsServer) Stats() Stats {
+	s.connLock.RLock()
+	defer s.connLock.RUnlock()
+	stats := Stats{
+		Remotes:          make([]RemoteStats, 0, len(s.conns)),
+		Dropped:          s.dropped.Load(),
+		SlowDisconnected: s.disconnected.Load(),
+	}
+	for _, conn := range s.conns {
+		stats.Remotes = append(stats.Remotes, conn.Stats())
+	}
+	return stats
+}
+
 func (s *wsServer) ListenAndServe() error {
+	if s.srv.TLSConfig != nil {
+		// certificates are already loaded into TLSConfig
+		return s.srv.ListenAndServeTLS("", "")
+	}
 	return s.srv.ListenAndServe()
 }
 
@@ -1,14 +1,378 @@
 package mps
 
 import (
-	"github.com/ethereum/go-ethereum/log"
+	"crypto/ecdsa"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/gorilla/websocket"
 )
 
-func TestWSServer(t *testing.T) {
-	wss := newWS(":7856", log.New())
-	err := wss.ListenAndServe()
+type testPool struct {
+	pending, queued map[common.Address][]*types.Transaction
+}
+
+func (p *testPool) SubscribeTransactions(ch chan<- core.NewTxsEvent, reorgs bool) event.Subscription {
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		<-quit
+		return nil
+	})
+}
+
+func (p *testPool) Content() (map[common.Address][]*types.Transaction, map[common.Address][]*types.Transaction) {
+	return p.pending, p.queued
+}
+
+func (p *testPool) Has(hash common.Hash) bool {
+	for _, content := range []map[common.Address][]*types.Transaction{p.pending, p.queued} {
+		for _, txs := range content {
+			for _, tx := range txs {
+				if tx.Hash() == hash {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func signedTx(t *testing.T, key *ecdsa.PrivateKey, nonce uint64) *types.Transaction {
+	tx, err := types.SignTx(types.NewTransaction(nonce, common.Address{0x01}, big.NewInt(1), 21000, big.NewInt(1), nil),
+		types.LatestSigner(params.TestChainConfig), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+// newTestServer returns a server and a conn to it, on which the handshake is done
+func newTestServer(t *testing.T, pool *testPool) (*wsServer, *websocket.Conn) {
+	wss, c := dialTestServer(t, DefaultConfig, pool)
+	handshake(t, c)
+	return wss, c
+}
+
+func handshake(t *testing.T, c *websocket.Conn) {
+	var hello Hello
+	readPacket(t, c, FeedTypeHello, &hello)
+	if err := c.WriteJSON(RequestPacket{Id: 1, Op: ClientOptHello, Hello: NewHello()}); err != nil {
+		t.Fatal(err)
+	}
+	var resp ResponsePacket
+	readPacket(t, c, FeedTypeResponse, &resp)
+	if !resp.Ok {
+		t.Fatalf("handshake failed: %s", resp.Message)
+	}
+}
+
+func dialTestServer(t *testing.T, cfg Config, pool *testPool) (*wsServer, *websocket.Conn) {
+	wss, err := newWS(cfg, log.New(), params.TestChainConfig, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(wss)
+	t.Cleanup(srv.Close)
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return wss, c
+}
+
+func readPacket(t *testing.T, c *websocket.Conn, want FeedType, v any) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	var packet FeedPacket
+	if err := c.ReadJSON(&packet); err != nil {
+		t.Fatal(err)
+	}
+	if packet.Type != want {
+		t.Fatalf("packet type = %d, want %d", packet.Type, want)
+	}
+	if err := json.Unmarshal(packet.Data, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWSServerSnapshot(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	pool := &testPool{
+		pending: map[common.Address][]*types.Transaction{from: {signedTx(t, key, 0), signedTx(t, key, 1)}},
+		queued:  map[common.Address][]*types.Transaction{from: {signedTx(t, key, 3)}},
+	}
+	_, c := newTestServer(t, pool)
+
+	var config params.ChainConfig
+	readPacket(t, c, FeedTypeChainConfig, &config)
+	if config.ChainID.Cmp(params.TestChainConfig.ChainID) != 0 {
+		t.Errorf("chain id = %v, want %v", config.ChainID, params.TestChainConfig.ChainID)
+	}
+
+	if err := c.WriteJSON(RequestPacket{Id: 1, Op: ClientOptSubscribe, Topic: TopicSnapshot}); err != nil {
+		t.Fatal(err)
+	}
+	var resp ResponsePacket
+	readPacket(t, c, FeedTypeResponse, &resp)
+	if !resp.Ok || resp.Id != 1 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	var snapshot SnapshotPacket
+	readPacket(t, c, FeedTypeSnapshot, &snapshot)
+	if !snapshot.Done {
+		t.Error("snapshot not done")
+	}
+	if len(snapshot.Pending.Txs) != 2 || len(snapshot.Queued.Txs) != 1 {
+		t.Fatalf("snapshot size = %d/%d, want 2/1", len(snapshot.Pending.Txs), len(snapshot.Queued.Txs))
+	}
+	for _, sender := range append(snapshot.Pending.Senders, snapshot.Queued.Senders...) {
+		if sender == nil || *sender != from {
+			t.Errorf("sender = %v, want %v", sender, from)
+		}
+	}
+}
+
+func TestWSServerSnapshotChunks(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	txs := make([]*types.Transaction, snapshotChunkSize+1)
+	for i := range txs {
+		txs[i] = signedTx(t, key, uint64(i))
+	}
+	wss, err := newWS(DefaultConfig, log.New(), params.TestChainConfig, &testPool{
+		pending: map[common.Address][]*types.Transaction{from: txs},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets := wss.Snapshot()
+	if len(packets) != 2 {
+		t.Fatalf("chunks = %d, want 2", len(packets))
+	}
+	if packets[0].Done || !packets[1].Done {
+		t.Error("only the last chunk should be done")
+	}
+	if n := len(packets[0].Pending.Txs) + len(packets[1].Pending.Txs); n != len(txs) {
+		t.Errorf("txs = %d, want %d", n, len(txs))
+	}
+}
+
+func TestWSServerResume(t *testing.T) {
+	wss, c := newTestServer(t, &testPool{})
+	var config params.ChainConfig
+	readPacket(t, c, FeedTypeChainConfig, &config)
+
+	for i := 0; i < 3; i++ {
+		wss.DispatchBlockedTxHashes([]common.Hash{{byte(i)}})
+	}
+	from := uint64(1)
+	if err := c.WriteJSON(RequestPacket{Id: 1, Op: ClientOptSubscribe, Topic: TopicBlockedTxHashes, ResumeFrom: &from}); err != nil {
+		t.Fatal(err)
+	}
+	var resp ResponsePacket
+	readPacket(t, c, FeedTypeResponse, &resp)
+	for _, want := range []uint64{2, 3} {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		var packet FeedPacket
+		if err := c.ReadJSON(&packet); err != nil {
+			t.Fatal(err)
+		}
+		if packet.Type != FeedTypeBlockedTxHashes || packet.Seq != want || packet.Time == 0 || packet.Prev != want-1 {
+			t.Errorf("replayed packet = %d seq %d prev %d time %d, want seq %d", packet.Type, packet.Seq, packet.Prev, packet.Time, want)
+		}
+	}
+
+	// the seqs of another server instance can't be resumed from
+	if err := c.WriteJSON(RequestPacket{Id: 3, Op: ClientOptSubscribe, Topic: TopicBlockedTxHashes, ResumeFrom: &from, Epoch: "restarted"}); err != nil {
+		t.Fatal(err)
+	}
+	readPacket(t, c, FeedTypeResponse, &resp)
+	var gap GapPacket
+	readPacket(t, c, FeedTypeGap, &gap)
+	if gap.ResumeFrom != 1 || gap.Latest != 3 {
+		t.Errorf("unexpected gap %+v", gap)
+	}
+
+	from = 42
+	if err := c.WriteJSON(RequestPacket{Id: 2, Op: ClientOptSubscribe, Topic: TopicBlockedTxHashes, ResumeFrom: &from}); err != nil {
+		t.Fatal(err)
+	}
+	readPacket(t, c, FeedTypeResponse, &resp)
+	readPacket(t, c, FeedTypeGap, &gap)
+	if gap.Topic != TopicBlockedTxHashes || gap.ResumeFrom != 42 || gap.Oldest != 1 || gap.Latest != 3 {
+		t.Errorf("unexpected gap %+v", gap)
+	}
+}
+
+func TestWSServerFilteredPrev(t *testing.T) {
+	wss, c := newTestServer(t, &testPool{})
+	var config params.ChainConfig
+	readPacket(t, c, FeedTypeChainConfig, &config)
+	key, other := newKey(t), newKey(t)
+	filter := &TxFilter{From: []common.Address{crypto.PubkeyToAddress(key.PublicKey)}}
+	if err := c.WriteJSON(RequestPacket{Id: 1, Op: ClientOptSubscribe, Topic: TopicNewTx, Filter: filter}); err != nil {
+		t.Fatal(err)
+	}
+	var resp ResponsePacket
+	readPacket(t, c, FeedTypeResponse, &resp)
+
+	// seq 2 is filtered out, the packet of seq 3 tells so by its prev
+	for i, k := range []*ecdsa.PrivateKey{key, other, key} {
+		wss.DispatchNewTxsEvent(core.NewTxsEvent{Txs: types.Transactions{signedTx(t, k, uint64(i))}})
+	}
+	for _, want := range [][2]uint64{{1, 0}, {3, 1}} {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		var packet FeedPacket
+		if err := c.ReadJSON(&packet); err != nil {
+			t.Fatal(err)
+		}
+		if packet.Seq != want[0] || packet.Prev != want[1] {
+			t.Errorf("packet seq %d prev %d, want %d %d", packet.Seq, packet.Prev, want[0], want[1])
+		}
+	}
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestWSServerHandshake(t *testing.T) {
+	tests := []struct {
+		req RequestPacket
+		ok  bool
+	}{
+		{RequestPacket{Id: 1, Op: ClientOptHello, Hello: NewHello()}, true},
+		{RequestPacket{Id: 1, Op: ClientOptHello, Hello: &Hello{Version: ProtocolVersion + 1, MinVersion: ProtocolVersion}}, true},
+		{RequestPacket{Id: 1, Op: ClientOptHello, Hello: &Hello{Version: ProtocolVersion + 2, MinVersion: ProtocolVersion + 1}}, false},
+		{RequestPacket{Id: 1, Op: ClientOptSubscribe, Topic: TopicNewTx}, false}, // client predating the handshake
+	}
+	for i, test := range tests {
+		_, c := dialTestServer(t, DefaultConfig, &testPool{})
+		var hello Hello
+		readPacket(t, c, FeedTypeHello, &hello)
+		if hello.Version != ProtocolVersion || len(hello.Topics) != len(SupportTopics) || len(hello.Encodings) != len(SupportEncodings) || hello.Epoch == "" {
+			t.Fatalf("test %d: unexpected hello %+v", i, hello)
+		}
+		if err := c.WriteJSON(test.req); err != nil {
+			t.Fatal(err)
+		}
+		var resp ResponsePacket
+		readPacket(t, c, FeedTypeResponse, &resp)
+		if resp.Ok != test.ok {
+			t.Errorf("test %d: response %+v, want ok %v", i, resp, test.ok)
+		}
+		if test.ok {
+			var config params.ChainConfig
+			readPacket(t, c, FeedTypeChainConfig, &config)
+			continue
+		}
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err := c.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseProtocolError) {
+			t.Errorf("test %d: err = %v, want protocol error close", i, err)
+		}
+	}
+}
+
+func TestWSServerDeadPeer(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.PingInterval = 20 * time.Millisecond
+	cfg.PongTimeout = 20 * time.Millisecond
+	for _, alive := range []bool{true, false} {
+		wss, c := dialTestServer(t, cfg, &testPool{})
+		handshake(t, c)
+		if alive {
+			// pings are only answered while reading
+			go func() {
+				for {
+					if _, _, err := c.ReadMessage(); err != nil {
+						return
+					}
+				}
+			}()
+		}
+		time.Sleep(200 * time.Millisecond)
+		if n := wss.connCount(); alive != (n == 1) {
+			t.Errorf("alive %v: conns = %d", alive, n)
+		}
+	}
+}
+
+func TestWSServerReadTimeout(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.PingInterval = 20 * time.Millisecond
+	cfg.PongTimeout = 40 * time.Millisecond
+	cfg.ReadTimeout = 30 * time.Millisecond
+	wss, c := dialTestServer(t, cfg, &testPool{})
+	handshake(t, c)
+	// subscribed once, and then only answering pings, way past ReadTimeout
+	if err := c.WriteJSON(RequestPacket{Id: 2, Op: ClientOptSubscribe, Topic: TopicNewTx}); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(300 * time.Millisecond)
+	if n := wss.connCount(); n != 1 {
+		t.Errorf("conns = %d, want the client answering pings kept", n)
+	}
+}
+
+func TestWSServerMaxConns(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.MaxConns = 2
+	wss, err := newWS(cfg, log.New(), params.TestChainConfig, &testPool{})
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(wss)
+	t.Cleanup(srv.Close)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	// the slots are reserved before the upgrade, so concurrent dials can't exceed the limit
+	var (
+		wg       sync.WaitGroup
+		accepted atomic.Int32
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, resp, err := websocket.DefaultDialer.Dial(url, nil)
+			if err != nil {
+				if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+					t.Errorf("dial: %v", err)
+				}
+				return
+			}
+			accepted.Add(1)
+			t.Cleanup(func() { c.Close() })
+		}()
+	}
+	wg.Wait()
+	if n := accepted.Load(); n != 2 {
+		t.Errorf("accepted %d conns, want 2", n)
 	}
 }
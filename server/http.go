@@ -9,6 +9,8 @@ import (
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/gin-gonic/gin"
+
+	"github.com/moodbase/TxForesight/txfpool/ethpool"
 )
 
 type PageInfo struct {
@@ -16,29 +18,47 @@ type PageInfo struct {
 	PageSize int `form:"pageSize" json:"pageSize" binding:"required"`
 }
 
+// SortInfo orders the txs by Sort, one of arrival, gasPrice, tip, value and gas,
+// in Order, asc or desc, the latest first by default
+type SortInfo struct {
+	Sort  string `form:"sort" json:"sort"`
+	Order string `form:"order" json:"order"`
+}
+
 func (s *Server) routeETH(tag ChainTag) {
 	// GET /{tag}
 	g := s.r.Group(string(tag))
+	pool := s.ethPools[tag]
+	// GET /{tag}/tx-pool?sort=gasPrice&order=desc, from the index of the sort key
 	g.GET("/tx-pool", func(ctx *gin.Context) {
-		var pageInfo PageInfo
-		err := ctx.ShouldBind(&pageInfo)
+		var sortInfo SortInfo
+		err := ctx.ShouldBind(&sortInfo)
 		if err != nil {
 			ctx.JSON(http.StatusBadRequest, gin.H{
 				"error": err.Error(),
 			})
-			slog.Error("failed to bind json", "err", err)
 			return
 		}
-		pool := s.ethPools[tag]
-		selected, total := pool.All(pageInfo.Page, pageInfo.PageSize)
-		ctx.JSON(http.StatusOK, gin.H{
-			"selected": selected,
-			"total":    total,
-		})
+		order, err := ethpool.ParseOrder(sortInfo.Sort, sortInfo.Order)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		pageHandler(func(page, pageSize int) ([]*ethpool.PoolTx, int) {
+			return pool.All(page, pageSize, order)
+		})(ctx)
+	})
+	// GET /{tag}/tx-pool/pending and /queued, the txs classified against their sender's on-chain nonce
+	g.GET("/tx-pool/pending", pageHandler(pool.Pending))
+	g.GET("/tx-pool/queued", pageHandler(pool.Queued))
+	// GET /{tag}/tx-pool/stats, the size and the eviction counters of the pool
+	g.GET("/tx-pool/stats", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, pool.Stats())
 	})
 	g.GET("/tx-pool/:hash", func(ctx *gin.Context) {
 		hashStr := ctx.Param("hash")
-		pool := s.ethPools[tag]
 		var hash common.Hash
 		err := hash.UnmarshalText([]byte(hashStr))
 		if err != nil {
@@ -52,12 +72,52 @@ func (s *Server) routeETH(tag ChainTag) {
 			hashStr: tx,
 		})
 	})
+	// GET /{tag}/tx-pool/:hash/replacements, the txs with the same sender and nonce, the original first
+	g.GET("/tx-pool/:hash/replacements", func(ctx *gin.Context) {
+		var hash common.Hash
+		err := hash.UnmarshalText([]byte(ctx.Param("hash")))
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		replacements, ok := pool.Replacements(hash)
+		if !ok {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error": "tx not found",
+			})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"replacements": replacements,
+		})
+	})
 	g.GET("/chain-config", func(ctx *gin.Context) {
-		config := s.ethPoolServers[tag].ChainConfig()
-		ctx.Data(http.StatusOK, "application/json", config)
+		ctx.JSON(http.StatusOK, s.ethPoolServers[tag].ChainConfig())
 	})
 }
 
+// pageHandler responds a page of the txs selected by list
+func pageHandler(list func(page, pageSize int) ([]*ethpool.PoolTx, int)) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var pageInfo PageInfo
+		err := ctx.ShouldBind(&pageInfo)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			slog.Error("failed to bind json", "err", err)
+			return
+		}
+		selected, total := list(pageInfo.Page, pageInfo.PageSize)
+		ctx.JSON(http.StatusOK, gin.H{
+			"selected": selected,
+			"total":    total,
+		})
+	}
+}
+
 func (s *Server) httpListen() {
 	err := s.httpListener.ListenAndServe()
 	if err != nil && !errors.Is(err, http.ErrServerClosed) {
@@ -2,10 +2,14 @@ package server
 
 import (
 	"errors"
+	"fmt"
 	"log/slog"
+	"math/big"
 	"net/http"
 	"sync"
+	"time"
 
+	"github.com/ethereum/go-ethereum/params"
 	"github.com/gin-gonic/gin"
 
 	"github.com/moodbase/TxForesight/server/txpoolserver/ethserver"
@@ -18,6 +22,11 @@ const (
 	ETH ChainTag = "eth"
 )
 
+// chainIDs are the chain ids the nodes of each chain must be on
+var chainIDs = map[ChainTag]*big.Int{
+	ETH: params.MainnetChainConfig.ChainID,
+}
+
 type Server struct {
 	r            *gin.Engine
 	httpListener *http.Server
@@ -44,34 +53,51 @@ func New(listenAddr string) *Server {
 	return s
 }
 
+// Start starts every txPool server and then the http listener,
+// the txPool servers are all stopped if any fails to start
 func (s *Server) Start() error {
-	for tag, server := range s.ethPoolServers {
-		slog.Info("start eth txPool server", "chain", tag)
-		go server.Start()
-		s.wg.Add(1)
-	}
 	if len(s.ethPoolServers) == 0 {
 		return errors.New("no txPool server registered")
 	}
+	for tag, server := range s.ethPoolServers {
+		slog.Info("start eth txPool server", "chain", tag)
+		if err := server.Start(); err != nil {
+			s.stopETHServers()
+			s.wg.Wait()
+			return fmt.Errorf("start eth txPool server %s: %w", tag, err)
+		}
+	}
 	go s.httpListen()
 	return nil
 }
 
 func (s *Server) Stop() {
+	s.stopETHServers()
+	s.httpShutdown()
+	s.wg.Wait()
+}
+
+// stopETHServers stops every eth txPool server in the background, started or not, see wg
+func (s *Server) stopETHServers() {
 	for tag, ethServer := range s.ethPoolServers {
+		s.wg.Add(1)
 		go func() {
 			ethServer.Stop()
 			slog.Info("stopped eth txPool server", "chain", tag)
 			s.wg.Done()
 		}()
 	}
-	s.httpShutdown()
-	s.wg.Wait()
 }
 
-func (s *Server) registerETHServer(tag ChainTag, rpcAddr, mpsAddr string) error {
-	pool := ethpool.NewTxfPool()
-	ethServer, err := ethserver.New(rpcAddr, mpsAddr, pool)
+func (s *Server) registerETHServer(tag ChainTag, cfg ethserver.Config) error {
+	pool := ethpool.NewTxfPool(ethpool.Config{
+		SenderCheck: ethpool.SenderFlag,
+		MaxTxs:      200_000,
+		MaxBytes:    256 << 20,
+		MaxAge:      3 * time.Hour,
+		EvictPolicy: ethpool.EvictLowestFee,
+	})
+	ethServer, err := ethserver.New(cfg, pool)
 	if err != nil {
 		return err
 	}
@@ -81,7 +107,14 @@ func (s *Server) registerETHServer(tag ChainTag, rpcAddr, mpsAddr string) error
 }
 
 func (s *Server) Register() {
-	err := s.registerETHServer(ETH, "http://localhost:8545", "localhost:7856")
+	err := s.registerETHServer(ETH, ethserver.Config{
+		ChainID:              chainIDs[ETH],
+		RPCEndpoint:          "http://localhost:8545",
+		MPSEndpoints:         []string{"localhost:7856"},
+		RPCSources:           []string{"localhost:7856"},
+		ReconcileInterval:    ethserver.DefaultReconcileInterval,
+		FallbackPollInterval: ethserver.DefaultFallbackPollInterval,
+	})
 	if err != nil {
 		slog.Error("failed to register eth server", "err", err)
 	}
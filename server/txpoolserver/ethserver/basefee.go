@@ -0,0 +1,52 @@
+package ethserver
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// baseFeeInterval is the interval of the base fee refreshes between the blocks announced by MPS
+const baseFeeInterval = 12 * time.Second
+
+// baseFeeLoop keeps the base fee of the pool at the one of the latest block of the rpc node,
+// refreshed on start, on every block announced by MPS and every interval
+func (s *ETHServer) baseFeeLoop() {
+	ticker := time.NewTicker(baseFeeInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.refreshBaseFee(); err != nil {
+			slog.Error("failed to refresh base fee", "endpoint", s.cfg.RPCEndpoint, "err", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-s.headCh:
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// triggerBaseFee refreshes the base fee after a new block, the triggers during a refresh are merged
+func (s *ETHServer) triggerBaseFee() {
+	select {
+	case s.headCh <- struct{}{}:
+	default:
+	}
+}
+
+func (s *ETHServer) refreshBaseFee() error {
+	ctx, cancel := context.WithTimeout(s.ctx, baseFeeInterval)
+	defer cancel()
+	head, err := s.chain.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// nil before london, the effective tips are the tip caps then
+	s.pool.SetBaseFee(head.BaseFee)
+	if !s.mpsDown() {
+		// the fallback resumes from there if MPS goes down
+		s.lastBlock.Store(head.Number)
+	}
+	return nil
+}
@@ -2,108 +2,286 @@ package ethserver
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/params"
 
 	"github.com/moodbase/TxForesight/client/mpsclient"
 	"github.com/moodbase/TxForesight/mps"
 	"github.com/moodbase/TxForesight/txfpool/ethpool"
 )
 
+// Config is the configuration of an ETHServer
+type Config struct {
+	// ChainID is the chain served, which the rpc node and every MPS must be on
+	ChainID     *big.Int
+	RPCEndpoint string
+	// RPCSources are the MPSEndpoints of the node behind RPCEndpoint, whose txs missing from
+	// its txpool are removed by the reconciliations. The txs of the other MPS are left to their drops.
+	RPCSources []string
+	// MPSEndpoints are the MPS of the nodes of the chain, usually one per region.
+	// Their txs are deduplicated into the same pool, attributed to the endpoint seeing them first.
+	MPSEndpoints []string
+	// ReconcileInterval is the interval of the reconciliations of the pool with the txpool
+	// of the rpc node, which also happen on start and after missing MPS packets.
+	// 0 disables the periodic reconciliations.
+	ReconcileInterval time.Duration
+	// FallbackPollInterval is the interval of the new head polls of the rpc node while
+	// no MPS is connected, so that mined txs still leave the pool. 0 disables the fallback.
+	FallbackPollInterval time.Duration
+}
+
+// chainReader reads the blocks of the rpc node
+type chainReader interface {
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error)
+}
+
+// node is the MPS connection of one node
+type node struct {
+	endpoint  string
+	cli       *mpsclient.Client
+	connected atomic.Bool
+	verified  atomic.Bool // its chain config matched the rpc node's, and it is subscribed since
+}
+
 type ETHServer struct {
+	cfg    Config
 	ethCli *ethclient.Client
-	mpsCli *mpsclient.Client
+	chain  chainReader // ethCli, faked by the tests
+	nodes  []*node
 
-	ctx    context.Context
-	cancel context.CancelFunc
-	feedCh chan *mps.FeedPacket
+	ctx         context.Context
+	cancel      context.CancelFunc
+	reconcileCh chan struct{}
+	stateCh     chan struct{} // signaled on every MPS connection state change
+	headCh      chan struct{} // signaled on every block announced by MPS
+	// lastBlock is the latest block whose txs left the pool, seen while MPS was up or polled
+	lastBlock atomic.Pointer[big.Int]
 
-	chainConfigJsonData []byte
-	pool                ethpool.Pool
+	// chainID is set by Start before any packet is handled, and chainConfig
+	// by the first MPS verified, before verifiedCh is closed
+	chainID      *big.Int
+	chainConfig  *params.ChainConfig
+	verifyOnce   sync.Once
+	verifiedCh   chan struct{}
+	unverifiedCh chan error // the MPS which stopped before being verified
+
+	pool ethpool.Pool
 }
 
-func New(ethEndpoint, mpsEndpoint string, pool ethpool.Pool) (*ETHServer, error) {
-	ethCli, err := ethclient.Dial(ethEndpoint)
+// New creates the server of the rpc node and MPS endpoints of cfg, the MPS which can't be
+// dialed yet are connected in the background
+func New(cfg Config, pool ethpool.Pool) (*ETHServer, error) {
+	if len(cfg.MPSEndpoints) == 0 {
+		return nil, errors.New("no mps endpoint")
+	}
+	ethCli, err := ethclient.Dial(cfg.RPCEndpoint)
 	if err != nil {
 		return nil, err
 	}
-	mpsCli, err := mpsclient.New(mpsEndpoint)
+	s := &ETHServer{
+		cfg:         cfg,
+		ethCli:      ethCli,
+		chain:       ethCli,
+		reconcileCh: make(chan struct{}, 1),
+		stateCh:     make(chan struct{}, 1),
+		headCh:      make(chan struct{}, 1),
+		verifiedCh:  make(chan struct{}),
+		pool:        pool,
+	}
+	for _, endpoint := range cfg.MPSEndpoints {
+		n := &node{endpoint: endpoint}
+		// Stream decodes the packets, so the binary encoding only saves bandwidth
+		n.cli, err = mpsclient.New(endpoint, mpsclient.WithBackgroundDial(), mpsclient.WithEncoding(mps.EncodingRLP), mpsclient.WithStateHandler(func(state mpsclient.ConnState, err error) {
+			if state == mpsclient.StateConnected {
+				slog.Info("mps connection state changed", "endpoint", endpoint, "state", state)
+			} else {
+				slog.Warn("mps connection state changed", "endpoint", endpoint, "state", state, "err", err)
+			}
+			n.connected.Store(state == mpsclient.StateConnected)
+			select {
+			case s.stateCh <- struct{}{}:
+			default:
+			}
+		}))
+		if err != nil {
+			s.close()
+			return nil, fmt.Errorf("connect mps %s: %w", endpoint, err)
+		}
+		s.nodes = append(s.nodes, n)
+	}
+	s.unverifiedCh = make(chan error, len(s.nodes))
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s, nil
+}
+
+// topics are subscribed in order, snapshot last so no tx falls between the snapshot and the new tx feed
+var topics = []mps.Topic{mps.TopicNewTx, mps.TopicBlockedTxHashes, mps.TopicDroppedTxs, mps.TopicReorg, mps.TopicSnapshot}
+
+// subscribeTimeout bounds the wait for the response to each subscription
+const subscribeTimeout = 10 * time.Second
+
+// startTimeout bounds the wait for the chain id of the rpc node and the chain config of the first MPS
+const startTimeout = 30 * time.Second
+
+// Start checks that the rpc node and at least one MPS are on the configured chain,
+// and then feeds the pool with the packets of every node in the background.
+// The other MPS are verified as they send their chain config, and only fed from then.
+func (s *ETHServer) Start() error {
+	ctx, cancel := context.WithTimeout(s.ctx, startTimeout)
+	defer cancel()
+	chainID, err := s.ethCli.ChainID(ctx)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("eth_chainId: %w", err)
+	}
+	if s.cfg.ChainID != nil && chainID.Cmp(s.cfg.ChainID) != 0 {
+		return fmt.Errorf("rpc node %s is on chain %v, want %v", s.cfg.RPCEndpoint, chainID, s.cfg.ChainID)
 	}
-	mpsCli.SubscribeTopicNewTx()
-	mpsCli.SubscribeTopicBlockedTxHashes()
-	ctx, cancel := context.WithCancel(context.Background())
+	s.chainID = chainID
+	for _, n := range s.nodes {
+		go s.packetLoop(n, n.cli.Stream(s.ctx))
+	}
+	var errs []error
+	for verified := false; !verified; {
+		select {
+		case <-s.verifiedCh:
+			verified = true
+		case err := <-s.unverifiedCh:
+			if errs = append(errs, err); len(errs) == len(s.nodes) {
+				return errors.Join(errs...)
+			}
+		case <-ctx.Done():
+			return fmt.Errorf("no mps chain config: %w", errors.Join(append(errs, ctx.Err())...))
+		}
+	}
+	slog.Info("verified chain config", "chainId", chainID, "config", s.chainConfig)
 
-	return &ETHServer{
-		ethCli: ethCli,
-		mpsCli: mpsCli,
+	go s.pool.Run(s.ctx)
+	go s.reconcileLoop()
+	go s.nonceLoop()
+	go s.baseFeeLoop()
+	if s.cfg.FallbackPollInterval > 0 {
+		go s.fallbackLoop()
+	}
+	return nil
+}
 
-		ctx:    ctx,
-		cancel: cancel,
-		feedCh: make(chan *mps.FeedPacket, 8),
+// verify checks the chain config sent by n, the first one verified sets the chain config
+// of the server, and n is subscribed once verified
+func (s *ETHServer) verify(n *node, config *params.ChainConfig) error {
+	if err := s.checkChainConfig(config); err != nil {
+		return err
+	}
+	s.verifyOnce.Do(func() {
+		s.chainConfig = config
+		s.pool.SetSigner(types.LatestSigner(config))
+		close(s.verifiedCh)
+	})
+	if !n.verified.Swap(true) {
+		slog.Info("verified mps chain config", "endpoint", n.endpoint)
+		// the responses are read along with the packets, which are handled by packetLoop meanwhile
+		go s.subscribe(n)
+	}
+	return nil
+}
 
-		pool: pool,
-	}, nil
+// checkChainConfig checks config is the one of the chain of the rpc node
+func (s *ETHServer) checkChainConfig(config *params.ChainConfig) error {
+	if config.ChainID == nil {
+		return errors.New("chain config without chain id")
+	}
+	if config.ChainID.Cmp(s.chainID) != 0 {
+		return fmt.Errorf("chain id %v, want %v", config.ChainID, s.chainID)
+	}
+	return nil
 }
 
-func (s *ETHServer) Start() {
-	go s.mpsCli.DrainLoop(s.feedCh)
-	s.packetLoop()
+func (s *ETHServer) subscribe(n *node) {
+	for _, topic := range topics {
+		ctx, cancel := context.WithTimeout(s.ctx, subscribeTimeout)
+		err := n.cli.Subscribe(ctx, topic, nil)
+		cancel()
+		switch {
+		case errors.Is(err, mpsclient.ErrRejected):
+			slog.Error("mps subscription rejected", "endpoint", n.endpoint, "topic", topic, "err", err)
+		case err != nil:
+			// the client keeps the subscription and replays it after reconnecting
+			slog.Warn("mps subscription unconfirmed", "endpoint", n.endpoint, "topic", topic, "err", err)
+		}
+	}
 }
 
 func (s *ETHServer) Stop() {
 	s.cancel()
-	s.mpsCli.Close()
+	s.close()
+}
+
+func (s *ETHServer) close() {
+	for _, n := range s.nodes {
+		n.cli.Close()
+	}
 	s.ethCli.Close()
 }
 
-func (s *ETHServer) ChainConfig() []byte {
-	return s.chainConfigJsonData
+// ChainConfig returns the chain config verified by Start
+func (s *ETHServer) ChainConfig() *params.ChainConfig {
+	return s.chainConfig
 }
 
-func (s *ETHServer) packetLoop() {
+// packetLoop feeds the pool with the packets of n, which is subscribed once its chain config
+// is verified, so that no other packet is received before
+func (s *ETHServer) packetLoop(n *node, stream *mpsclient.Stream) {
+	var cause error // why n stopped
+	defer func() {
+		if !n.verified.Load() {
+			if cause == nil {
+				cause = errors.New("closed before sending its chain config")
+			}
+			s.unverifiedCh <- fmt.Errorf("mps %s: %w", n.endpoint, cause)
+		}
+	}()
 	for {
 		select {
-		case packet := <-s.feedCh:
-			switch packet.Type {
-			case mps.FeedTypeChainConfig:
-				s.chainConfigJsonData = packet.Data
-				slog.Info("received chain config json data", "data[unverified]", string(s.chainConfigJsonData))
-			case mps.FeedTypeTransactions:
-				var txsWithSender mps.TxsWithSender
-				err := json.Unmarshal(packet.Data, &txsWithSender)
-				if err != nil {
-					slog.Error("invalid transactions", "err", err, "data", packet.Data)
-				} else {
-					slog.Info("received transactions", "len", len(txsWithSender.Txs))
-				}
-				s.pool.Feed(&txsWithSender)
-			case mps.FeedTypeBlockedTxHashes:
-				var hashes []common.Hash
-				err := json.Unmarshal(packet.Data, &hashes)
-				if err != nil {
-					slog.Error("invalid blocked tx hashes", "err", err, "data", packet.Data)
-				} else {
-					slog.Info("received blocked tx hashes:", "len", len(hashes))
-				}
-				s.pool.Block(hashes)
-			case mps.FeedTypeResponse:
-				var resp mps.ResponsePacket
-				err := json.Unmarshal(packet.Data, &resp)
-				if err != nil {
-					slog.Info("invalid response", "err", err, "data", packet.Data)
-				} else {
-					slog.Info("received response:", "resp", resp)
-				}
-			default:
-				slog.Info("unknown packet type", "type", packet.Type, "data", packet.Data)
+		case config := <-stream.ChainConfig:
+			// sent first, and again after every reconnect as the node may have been switched to another chain
+			if cause = s.verify(n, config); cause != nil {
+				slog.Error("mps on another chain, disconnecting", "endpoint", n.endpoint, "err", cause)
+				n.cli.Close()
 			}
-		case <-s.ctx.Done():
-			slog.Info("packet handle loop exit")
+		case txs := <-stream.Txs:
+			slog.Info("received transactions", "endpoint", n.endpoint, "len", len(txs.Txs))
+			s.pool.Feed(n.endpoint, txs)
+		case snapshot := <-stream.Snapshots:
+			slog.Info("received snapshot", "endpoint", n.endpoint, "pending", len(snapshot.Pending.Txs), "queued", len(snapshot.Queued.Txs), "done", snapshot.Done)
+			s.pool.Backfill(n.endpoint, &snapshot.Pending)
+			s.pool.Backfill(n.endpoint, &snapshot.Queued)
+		case hashes := <-stream.BlockedTxHashes:
+			slog.Info("received blocked tx hashes:", "endpoint", n.endpoint, "len", len(hashes))
+			s.pool.Block(hashes)
+			s.triggerBaseFee()
+		case dropped := <-stream.Dropped:
+			slog.Info("received dropped txs", "endpoint", n.endpoint, "len", len(dropped))
+			s.pool.Drop(n.endpoint, dropped)
+		case e := <-stream.Reorgs:
+			slog.Info("received reorg", "endpoint", n.endpoint, "old", e.OldNumber, "new", e.NewNumber, "depth", e.Depth)
+			s.pool.Reorg(n.endpoint, e)
+		case gap := <-stream.Gaps:
+			slog.Warn("missed mps packets", "endpoint", n.endpoint, "topic", gap.Topic, "resumeFrom", gap.ResumeFrom, "oldest", gap.Oldest, "latest", gap.Latest)
+			s.triggerReconcile()
+		case err := <-stream.Errors:
+			slog.Error("mps stream", "endpoint", n.endpoint, "err", err)
+			cause = err
+		case <-stream.Done:
+			slog.Info("packet handle loop exit", "endpoint", n.endpoint)
 			return
 		}
 	}
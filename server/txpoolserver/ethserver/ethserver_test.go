@@ -0,0 +1,123 @@
+package ethserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/gorilla/websocket"
+
+	"github.com/moodbase/TxForesight/mps"
+	"github.com/moodbase/TxForesight/txfpool/ethpool"
+)
+
+func TestVerifyChainConfig(t *testing.T) {
+	s := newTestServer(new(testChain), ethpool.NewTxfPool(ethpool.Config{}))
+	defer s.cancel()
+	s.chainID = big.NewInt(1)
+	if err := s.checkChainConfig(&params.ChainConfig{ChainID: big.NewInt(1)}); err != nil {
+		t.Errorf("same chain id: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		config *params.ChainConfig
+		err    string
+	}{
+		{"wrong chain id", &params.ChainConfig{ChainID: big.NewInt(5)}, "chain id 5, want 1"},
+		{"nil chain id", &params.ChainConfig{}, "chain config without chain id"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := s.verify(s.nodes[0], test.config); err == nil || err.Error() != test.err {
+				t.Errorf("err = %v, want %q", err, test.err)
+			}
+			if s.nodes[0].verified.Load() || s.chainConfig != nil {
+				t.Error("mps verified on another chain")
+			}
+			select {
+			case <-s.verifiedCh:
+				t.Error("server verified on another chain")
+			default:
+			}
+		})
+	}
+}
+
+// serveMPS serves the handshake and then config as an MPS, until the client leaves
+func serveMPS(t *testing.T, config *params.ChainConfig) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		data, _ := json.Marshal(mps.NewHello())
+		if err := c.WriteJSON(mps.FeedPacket{Type: mps.FeedTypeHello, Data: data}); err != nil {
+			return
+		}
+		var req mps.RequestPacket
+		if err := c.ReadJSON(&req); err != nil {
+			return
+		}
+		data, _ = json.Marshal(mps.ResponsePacket{Id: req.Id, Ok: true})
+		if err := c.WriteJSON(mps.FeedPacket{Type: mps.FeedTypeResponse, Data: data}); err != nil {
+			return
+		}
+		data, _ = json.Marshal(config)
+		if err := c.WriteJSON(mps.FeedPacket{Type: mps.FeedTypeChainConfig, Data: data}); err != nil {
+			return
+		}
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// serveRPC serves eth_chainId as an rpc node on chainID
+func serveRPC(t *testing.T, chainID int64) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID json.RawMessage `json:"id"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":%s,"result":"0x%x"}`, req.ID, chainID)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestStartUnverified(t *testing.T) {
+	wrong := serveMPS(t, &params.ChainConfig{ChainID: big.NewInt(5)})
+	noChainID := serveMPS(t, &params.ChainConfig{})
+	s, err := New(Config{
+		RPCEndpoint:  serveRPC(t, 1).URL,
+		MPSEndpoints: []string{strings.TrimPrefix(wrong.URL, "http://"), strings.TrimPrefix(noChainID.URL, "http://")},
+	}, ethpool.NewTxfPool(ethpool.Config{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	// Start gives up once every MPS failed its verification, without waiting for startTimeout
+	err = s.Start()
+	if err == nil {
+		t.Fatal("started without any mps on the chain")
+	}
+	for _, want := range []string{"chain id 5, want 1", "chain config without chain id"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("err = %v, want it to contain %q", err, want)
+		}
+	}
+}
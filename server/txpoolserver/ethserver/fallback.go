@@ -0,0 +1,104 @@
+package ethserver
+
+import (
+	"context"
+	"log/slog"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// DefaultFallbackPollInterval is the interval of the new head polls while MPS is down
+const DefaultFallbackPollInterval = 4 * time.Second
+
+// maxFallbackBlocks bounds the blocks fetched by one poll, the older ones are left to the reconciliation
+const maxFallbackBlocks = 64
+
+// fallbackOverlap is the number of blocks polled again before the last one seen while MPS was up,
+// which is read from the rpc node while MPS may lag behind it
+const fallbackOverlap = 2
+
+// mpsDown reports whether no MPS node is connected, so that nothing removes the mined txs
+func (s *ETHServer) mpsDown() bool {
+	for _, n := range s.nodes {
+		if n.connected.Load() {
+			return false
+		}
+	}
+	return true
+}
+
+// fallbackLoop polls the new heads of the rpc node while MPS is down, and removes their txs
+// from the pool. The node is polled rather than subscribed as the rpc endpoint may be http.
+// Polling resumes after the last block seen while MPS was up, so the blocks mined until
+// MPS is found down are caught up, within maxFallbackBlocks.
+// Once MPS is back, the blocks missed meanwhile are replayed by MPS or reconciled.
+func (s *ETHServer) fallbackLoop() {
+	ticker := time.NewTicker(s.cfg.FallbackPollInterval)
+	defer ticker.Stop()
+	var last *big.Int // last block polled, nil while MPS is up
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stateCh:
+		case <-s.ctx.Done():
+			return
+		}
+		if !s.mpsDown() {
+			if last != nil {
+				slog.Info("mps recovered, stop polling blocks", "endpoint", s.cfg.RPCEndpoint, "last", last)
+				last = nil
+			}
+			continue
+		}
+		if last == nil {
+			seen := s.lastBlock.Load()
+			slog.Warn("mps down, polling blocks", "endpoint", s.cfg.RPCEndpoint, "lastSeen", seen)
+			if seen != nil {
+				last = new(big.Int).Sub(seen, big.NewInt(fallbackOverlap+1))
+			}
+		}
+		var err error
+		if last, err = s.pollBlocks(last); err != nil {
+			slog.Error("failed to poll blocks", "endpoint", s.cfg.RPCEndpoint, "err", err)
+		}
+	}
+}
+
+// pollBlocks removes the txs of the blocks after last up to the head from the pool,
+// starting with the head if last is nil. It returns the last block removed.
+func (s *ETHServer) pollBlocks(last *big.Int) (*big.Int, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, s.cfg.FallbackPollInterval)
+	defer cancel()
+	head, err := s.chain.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return last, err
+	}
+	s.pool.SetBaseFee(head.BaseFee)
+	from := new(big.Int).Set(head.Number)
+	if last != nil {
+		from.Add(last, common.Big1)
+	}
+	if oldest := new(big.Int).Sub(head.Number, big.NewInt(maxFallbackBlocks-1)); from.Cmp(oldest) < 0 {
+		from = oldest
+	}
+	if from.Sign() < 0 {
+		from = new(big.Int)
+	}
+	for number := from; number.Cmp(head.Number) <= 0; number = new(big.Int).Add(number, common.Big1) {
+		block, err := s.chain.BlockByNumber(ctx, number)
+		if err != nil {
+			return last, err
+		}
+		hashes := make([]common.Hash, len(block.Transactions()))
+		for i, tx := range block.Transactions() {
+			hashes[i] = tx.Hash()
+		}
+		slog.Info("polled block", "number", number, "txs", len(hashes))
+		s.pool.Block(hashes)
+		last = number
+		s.lastBlock.Store(number)
+	}
+	return last, nil
+}
@@ -0,0 +1,171 @@
+package ethserver
+
+import (
+	"context"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/moodbase/TxForesight/mps"
+	"github.com/moodbase/TxForesight/txfpool/ethpool"
+)
+
+// testChain is a chain of the rpc node, block i mines txs[i] if any
+type testChain struct {
+	lock   sync.Mutex
+	blocks []*types.Block
+	polled []uint64
+}
+
+func (c *testChain) mine(txs ...*types.Transaction) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	header := &types.Header{Number: big.NewInt(int64(len(c.blocks))), BaseFee: big.NewInt(1)}
+	c.blocks = append(c.blocks, types.NewBlockWithHeader(header).WithBody(types.Body{Transactions: txs}))
+}
+
+func (c *testChain) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.blocks[len(c.blocks)-1].Header(), nil
+}
+
+func (c *testChain) BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.polled = append(c.polled, number.Uint64())
+	return c.blocks[number.Uint64()], nil
+}
+
+// reset returns the blocks polled so far and forgets them
+func (c *testChain) reset() []uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	polled := c.polled
+	c.polled = nil
+	return polled
+}
+
+func newTestServer(chain chainReader, pool ethpool.Pool) *ETHServer {
+	n := &node{endpoint: "mps"}
+	n.connected.Store(true)
+	s := &ETHServer{
+		cfg:          Config{FallbackPollInterval: 10 * time.Millisecond},
+		chain:        chain,
+		nodes:        []*node{n},
+		stateCh:      make(chan struct{}, 1),
+		headCh:       make(chan struct{}, 1),
+		verifiedCh:   make(chan struct{}),
+		unverifiedCh: make(chan error, 1),
+		pool:         pool,
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s
+}
+
+// setMPS switches the MPS connection of s up or down
+func (s *ETHServer) setMPS(up bool) {
+	s.nodes[0].connected.Store(up)
+	select {
+	case s.stateCh <- struct{}{}:
+	default:
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+	}
+}
+
+func TestFallbackSwitchover(t *testing.T) {
+	from := common.Address{0x02}
+	txs := make([]*types.Transaction, 9)
+	senders := make([]*common.Address, len(txs))
+	for i := range txs {
+		txs[i] = types.NewTransaction(uint64(i), common.Address{0x01}, big.NewInt(1), 21000, big.NewInt(1), nil)
+		senders[i] = &from
+	}
+	pool := ethpool.NewTxfPool(ethpool.Config{})
+	pool.Feed("mps", &mps.TxsWithSender{Txs: txs[4:], Senders: senders[4:]})
+	held := func(i int) bool {
+		_, ok := pool.Get(txs[i].Hash())
+		return ok
+	}
+
+	chain := new(testChain)
+	for i := 0; i < 4; i++ {
+		chain.mine(txs[i])
+	}
+	s := newTestServer(chain, pool)
+	defer s.cancel()
+	// MPS sees block 3, blocks 4 and 5 are mined before MPS is found down
+	if err := s.refreshBaseFee(); err != nil {
+		t.Fatal(err)
+	}
+	chain.mine(txs[4])
+	chain.mine(txs[5])
+	go s.fallbackLoop()
+	s.setMPS(false)
+	waitFor(t, "the blocks mined since MPS went down", func() bool { return !held(4) && !held(5) })
+	if polled := chain.reset(); polled[0] != 3-fallbackOverlap {
+		t.Errorf("polled from %d, want %d", polled[0], 3-fallbackOverlap)
+	}
+
+	// polling stops once MPS is back
+	s.setMPS(true)
+	time.Sleep(50 * time.Millisecond)
+	chain.reset()
+	chain.mine(txs[6])
+	chain.mine(txs[7])
+	time.Sleep(50 * time.Millisecond)
+	if polled := chain.reset(); len(polled) != 0 {
+		t.Errorf("polled %v while MPS is up", polled)
+	}
+	// the rpc node is at block 7 while MPS lags and only announced block 6
+	if err := s.refreshBaseFee(); err != nil {
+		t.Fatal(err)
+	}
+	pool.Block([]common.Hash{txs[6].Hash()})
+
+	chain.mine(txs[8])
+	s.setMPS(false)
+	waitFor(t, "the blocks MPS missed", func() bool { return !held(7) && !held(8) })
+}
+
+func TestPollBlocksWindow(t *testing.T) {
+	chain := new(testChain)
+	for i := 0; i <= 100; i++ {
+		chain.mine()
+	}
+	s := newTestServer(chain, ethpool.NewTxfPool(ethpool.Config{}))
+	defer s.cancel()
+
+	// the catch up is bounded, the older blocks are left to the reconciliation
+	last, err := s.pollBlocks(big.NewInt(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	polled := chain.reset()
+	if last.Uint64() != 100 || len(polled) != maxFallbackBlocks || polled[0] != 100-maxFallbackBlocks+1 {
+		t.Errorf("polled %d blocks from %d up to %v, want %d from %d up to 100", len(polled), polled[0], last, maxFallbackBlocks, 100-maxFallbackBlocks+1)
+	}
+	// then only the new blocks are polled
+	chain.mine()
+	if last, _ = s.pollBlocks(last); last.Uint64() != 101 {
+		t.Errorf("last = %v, want 101", last)
+	}
+	if polled := chain.reset(); len(polled) != 1 || polled[0] != 101 {
+		t.Errorf("polled %v, want [101]", polled)
+	}
+	if got := s.lastBlock.Load(); got.Uint64() != 101 {
+		t.Errorf("last block = %v, want 101", got)
+	}
+}
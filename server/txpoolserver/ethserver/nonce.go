@@ -0,0 +1,79 @@
+package ethserver
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// nonceInterval is the interval of the resolutions of the on-chain nonces of new senders
+const nonceInterval = 2 * time.Second
+
+// nonceBatchSize bounds the eth_getTransactionCount calls of one batch request
+const nonceBatchSize = 256
+
+// nonceMaxAge is the age after which the nonce of a sender without pending tx is resolved again
+const nonceMaxAge = time.Minute
+
+// nonceLoop resolves the on-chain nonces of the senders new to the pool, so that their txs are
+// classified as pending or queued. The nonces are then kept up to date by the mined txs,
+// and resolved again after nonceMaxAge for the senders whose txs are all queued.
+func (s *ETHServer) nonceLoop() {
+	ticker := time.NewTicker(nonceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.ctx.Done():
+			return
+		}
+		if err := s.resolveNonces(); err != nil {
+			slog.Error("failed to resolve sender nonces", "endpoint", s.cfg.RPCEndpoint, "err", err)
+		}
+	}
+}
+
+// resolveNonces fetches the on-chain nonces of the unresolved or outdated senders in batches
+func (s *ETHServer) resolveNonces() error {
+	for {
+		addrs := s.pool.UnresolvedSenders(nonceBatchSize, nonceMaxAge)
+		if len(addrs) == 0 {
+			return nil
+		}
+		nonces := make([]hexutil.Uint64, len(addrs))
+		batch := make([]rpc.BatchElem, len(addrs))
+		for i, addr := range addrs {
+			batch[i] = rpc.BatchElem{
+				Method: "eth_getTransactionCount",
+				Args:   []any{addr, "latest"},
+				Result: &nonces[i],
+			}
+		}
+		ctx, cancel := context.WithTimeout(s.ctx, nonceInterval)
+		err := s.ethCli.Client().BatchCallContext(ctx, batch)
+		cancel()
+		if err != nil {
+			return err
+		}
+		resolved := make(map[common.Address]uint64, len(addrs))
+		for i, elem := range batch {
+			if elem.Error != nil {
+				slog.Warn("eth_getTransactionCount", "addr", addrs[i], "err", elem.Error)
+				continue
+			}
+			resolved[addrs[i]] = uint64(nonces[i])
+		}
+		if len(resolved) == 0 {
+			// every call failed, retry on the next tick rather than spin
+			return nil
+		}
+		s.pool.SetNonces(resolved)
+		if len(addrs) < nonceBatchSize {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package ethserver
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/moodbase/TxForesight/mps"
+)
+
+// DefaultReconcileInterval is the interval of the reconciliations with the txpool of the rpc node
+const DefaultReconcileInterval = 5 * time.Minute
+
+// reconcileTimeout bounds the txpool_content call, which returns the whole txpool
+const reconcileTimeout = 30 * time.Second
+
+// rpcTx is a tx of the txpool_content response, which carries its sender
+type rpcTx struct {
+	tx   *types.Transaction
+	from common.Address
+}
+
+func (t *rpcTx) UnmarshalJSON(data []byte) error {
+	var from struct {
+		From common.Address `json:"from"`
+	}
+	if err := json.Unmarshal(data, &from); err != nil {
+		return err
+	}
+	t.tx = new(types.Transaction)
+	t.from = from.From
+	return t.tx.UnmarshalJSON(data)
+}
+
+// txpoolContent is the response of txpool_content, txs are indexed by sender and nonce
+type txpoolContent struct {
+	Pending map[common.Address]map[string]*rpcTx `json:"pending"`
+	Queued  map[common.Address]map[string]*rpcTx `json:"queued"`
+}
+
+// txs flattens the pending and queued txs of the content
+func (c *txpoolContent) txs() *mps.TxsWithSender {
+	txs := new(mps.TxsWithSender)
+	for _, part := range []map[common.Address]map[string]*rpcTx{c.Pending, c.Queued} {
+		for _, byNonce := range part {
+			for _, tx := range byNonce {
+				from := tx.from
+				txs.Txs = append(txs.Txs, tx.tx)
+				txs.Senders = append(txs.Senders, &from)
+			}
+		}
+	}
+	return txs
+}
+
+// reconcileLoop reconciles the pool with the txpool of the rpc node on start, every interval
+// if any, and whenever triggered, e.g. after missing MPS packets
+func (s *ETHServer) reconcileLoop() {
+	var tick <-chan time.Time
+	if s.cfg.ReconcileInterval > 0 {
+		ticker := time.NewTicker(s.cfg.ReconcileInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		if err := s.reconcile(); err != nil {
+			slog.Error("failed to reconcile txpool", "endpoint", s.cfg.RPCEndpoint, "err", err)
+		}
+		select {
+		case <-tick:
+		case <-s.reconcileCh:
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// triggerReconcile asks reconcileLoop for a reconciliation, without waiting for it
+func (s *ETHServer) triggerReconcile() {
+	select {
+	case s.reconcileCh <- struct{}{}:
+	default:
+	}
+}
+
+func (s *ETHServer) reconcile() error {
+	ctx, cancel := context.WithTimeout(s.ctx, reconcileTimeout)
+	defer cancel()
+	fetchedAt := time.Now()
+	var content txpoolContent
+	if err := s.ethCli.Client().CallContext(ctx, &content, "txpool_content"); err != nil {
+		return err
+	}
+	txs := content.txs()
+	added, removed := s.pool.Reconcile(s.cfg.RPCEndpoint, s.cfg.RPCSources, txs, fetchedAt)
+	// drift is what the MPS feeds missed, or failed to remove, since the last reconciliation
+	slog.Info("reconciled txpool", "endpoint", s.cfg.RPCEndpoint, "node", len(txs.Txs),
+		"added", added, "removed", removed, "elapsed", time.Since(fetchedAt))
+	return nil
+}
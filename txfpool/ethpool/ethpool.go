@@ -1,11 +1,15 @@
 package ethpool
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
+	"maps"
 	"math/big"
 	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
@@ -23,6 +27,50 @@ type PoolTx struct {
 	From     *common.Address    `json:"from"`
 	To       *common.Address    `json:"to"`
 	Value    *big.Int           `json:"value"`
+
+	// GasPrice is the fee cap of the dynamic fee txs, which also have a tip cap.
+	// EffectiveTip is the tip paid at the latest base fee, negative if the fee cap is below it,
+	// nil while the base fee is unknown. EffectiveGasPrice is the gas price paid at the latest
+	// base fee, the fee cap while it's unknown.
+	Type              uint8    `json:"type"`
+	GasTipCap         *big.Int `json:"gasTipCap"`
+	GasFeeCap         *big.Int `json:"gasFeeCap"`
+	EffectiveTip      *big.Int `json:"effectiveTip"`
+	EffectiveGasPrice *big.Int `json:"effectiveGasPrice"`
+	// AccessListSize and AccessListKeys are the addresses and the storage keys of the access list
+	AccessListSize int      `json:"accessListSize,omitempty"`
+	AccessListKeys int      `json:"accessListKeys,omitempty"`
+	BlobFeeCap     *big.Int `json:"blobFeeCap,omitempty"`
+	BlobHashes     int      `json:"blobHashes,omitempty"`
+
+	// FirstSeenBy is the node which announced the tx first, at FirstSeen in unix milli.
+	// Delays are the milliseconds each node announced it after FirstSeen, as received by
+	// TxForesight, so they include the latency between the nodes and TxForesight.
+	// The txs backfilled from a txpool content aren't announcements, so FirstSeenBy is empty
+	// and Delays are left empty, while FirstSeen is when they were added.
+	FirstSeenBy string           `json:"firstSeenBy"`
+	FirstSeen   int64            `json:"firstSeen"`
+	Delays      map[string]int64 `json:"delays"`
+
+	// SenderMismatch flags a tx whose sender announced by ClaimedFrom doesn't match its signature
+	SenderMismatch bool            `json:"senderMismatch,omitempty"`
+	ClaimedFrom    *common.Address `json:"claimedFrom,omitempty"`
+
+	Status TxStatus `json:"status"`
+	// SupersededBy is the tx replacing this one with the same sender and nonce, see TxfPool.Replacements
+	SupersededBy *common.Hash `json:"supersededBy,omitempty"`
+
+	seq          uint64          // order of addition to the pool
+	sources      map[string]bool // nodes holding the tx in their txpool
+	supersededAt int64           // unix milli, set along with SupersededBy
+}
+
+// clone copies tx, so that it can be read without holding the pool lock
+func (tx *PoolTx) clone() *PoolTx {
+	cpy := *tx
+	cpy.Delays = maps.Clone(tx.Delays)
+	cpy.sources = nil
+	return &cpy
 }
 
 func (tx *PoolTx) String() string {
@@ -41,36 +89,108 @@ func (tx *PoolTx) String() string {
 	return fmt.Sprintf("tx: nonce=%d from=%s value=%d to=%s", tx.Nonce, from, value, to)
 }
 
+// Pool is fed by the MPS of one or several nodes of the same chain,
+// source is the node a tx is announced by
 type Pool interface {
-	Feed(txs *mps.TxsWithSender)
+	Feed(source string, txs *mps.TxsWithSender)
+	// Backfill adds the txs held by source without attributing them, see PoolTx.FirstSeenBy
+	Backfill(source string, txs *mps.TxsWithSender)
 	Block(hashes []common.Hash)
+	Drop(source string, dropped []mps.DroppedTx)
+	Reorg(source string, e *mps.ReorgEvent)
+	Reconcile(source string, backed []string, content *mps.TxsWithSender, fetchedAt time.Time) (added, removed int)
+	SetSigner(signer types.Signer)
+	// SetBaseFee sets the base fee of the latest block, which the effective tips are computed at
+	SetBaseFee(baseFee *big.Int)
+	// Run runs the background maintenance of the pool, such as evictions, until ctx is done
+	Run(ctx context.Context)
+	Stats() Stats
 
-	//Pend(hashes []common.Hash)
-	//Queue(hashes []common.Hash)
-	//
-	//Pending() []*types.Transaction
-	//Queuing() []*types.Transaction
+	// SetNonces sets the on-chain nonces of senders, which classify their txs as pending or queued,
+	// UnresolvedSenders lists the senders whose nonce is still unknown, or outdated after maxAge
+	SetNonces(nonces map[common.Address]uint64)
+	UnresolvedSenders(limit int, maxAge time.Duration) []common.Address
 
-	All(page, pageSize int) (selected []*PoolTx, total int)
+	// All, Pending, Queued and Get return copies of the txs, Pending and Queued the latest first
+	All(page, pageSize int, order Order) (selected []*PoolTx, total int)
+	Pending(page, pageSize int) (selected []*PoolTx, total int)
+	Queued(page, pageSize int) (selected []*PoolTx, total int)
 	Get(hash common.Hash) (*PoolTx, bool)
+	Replacements(hash common.Hash) ([]Replacement, bool)
+}
+
+// Config is the configuration of a TxfPool
+type Config struct {
+	SenderCheck SenderCheck
+
+	// MaxTxs, MaxBytes and MaxAge limit the txs held, 0 means no limit. The txs older than
+	// MaxAge are evicted first, and then the ones chosen by EvictPolicy while over MaxTxs or MaxBytes.
+	// The superseded txs count toward MaxBytes and MaxAge. Evictions are run by TxfPool.Run.
+	MaxTxs      int
+	MaxBytes    uint64
+	MaxAge      time.Duration
+	EvictPolicy EvictPolicy
 }
 
 type TxfPool struct {
-	lock sync.RWMutex
-	m    map[common.Hash]*PoolTx
-	all  []*PoolTx
-	//pending []*types.Transaction
-	//queuing []*types.Transaction
+	cfg     Config
+	signer  atomic.Value // types.Signer
+	baseFee atomic.Pointer[big.Int]
+
+	lock    sync.RWMutex
+	m       map[common.Hash]*PoolTx
+	all     []*PoolTx
+	bytes   uint64                        // encoded size of all and superseded
+	senders map[common.Address]*senderTxs // nonce index
+	indexes map[SortKey]*sortedIndex
+	seq     uint64 // seq of the last tx added
+
+	// superseded are the replaced txs, kept along with their replacement chains until the nonce is spent,
+	// or until their replacement is given up, see pruneChains
+	superseded map[common.Hash]*PoolTx
+	chains     map[common.Address]map[uint64]replacementChain
+
+	// evicted are the hashes of the txs evicted with their expiry in unix milli, which are not
+	// added back meanwhile, e.g. by the next snapshot or reconciliation, each offer extends it
+	evicted           map[common.Hash]int64
+	evictedByAge      atomic.Uint64
+	evictedByCapacity atomic.Uint64
 }
 
-func NewTxfPool() *TxfPool {
+func NewTxfPool(cfg Config) *TxfPool {
 	return &TxfPool{
-		all: make([]*PoolTx, 0, 256),
-		m:   make(map[common.Hash]*PoolTx, 256),
+		cfg:     cfg,
+		all:     make([]*PoolTx, 0, 256),
+		m:       make(map[common.Hash]*PoolTx, 256),
+		senders: make(map[common.Address]*senderTxs),
+		indexes: newSortedIndexes(),
+
+		superseded: make(map[common.Hash]*PoolTx),
+		chains:     make(map[common.Address]map[uint64]replacementChain),
+		evicted:    make(map[common.Hash]int64),
 	}
 }
 
-func (p *TxfPool) Feed(txsWithSender *mps.TxsWithSender) {
+// Feed adds the txs announced by source, the txs already known are deduplicated by hash
+// and only record the delay of source
+func (p *TxfPool) Feed(source string, txsWithSender *mps.TxsWithSender) {
+	txs := p.checkSenders(source, newPoolTxs(source, txsWithSender, time.Now().UnixMilli(), true))
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.add(source, txs)
+}
+
+// Backfill adds the txs held by source, e.g. its txpool snapshot, which aren't announcements,
+// so they neither claim the first seen nor record delays
+func (p *TxfPool) Backfill(source string, txsWithSender *mps.TxsWithSender) {
+	txs := p.checkSenders(source, newPoolTxs(source, txsWithSender, time.Now().UnixMilli(), false))
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.add(source, txs)
+}
+
+// newPoolTxs builds the txs held by source, attributed to source at now if announced
+func newPoolTxs(source string, txsWithSender *mps.TxsWithSender, now int64, announced bool) []*PoolTx {
 	txs := make([]*PoolTx, len(txsWithSender.Txs))
 	for i, tx := range txsWithSender.Txs {
 		txs[i] = &PoolTx{
@@ -83,25 +203,94 @@ func (p *TxfPool) Feed(txsWithSender *mps.TxsWithSender) {
 			From:     txsWithSender.Senders[i],
 			To:       tx.To(),
 			Value:    tx.Value(),
+
+			Type:           tx.Type(),
+			GasTipCap:      tx.GasTipCap(),
+			GasFeeCap:      tx.GasFeeCap(),
+			AccessListSize: len(tx.AccessList()),
+			AccessListKeys: tx.AccessList().StorageKeys(),
+			BlobFeeCap:     tx.BlobGasFeeCap(),
+			BlobHashes:     len(tx.BlobHashes()),
+
+			FirstSeen: now,
+			Delays:    make(map[string]int64),
+			sources:   map[string]bool{source: true},
+		}
+		if announced {
+			txs[i].FirstSeenBy = source
+			txs[i].Delays[source] = 0
 		}
 	}
-	p.lock.Lock()
-	defer p.lock.Unlock()
-	// NOTE: the time of transactions is not guaranteed to be in order
-	// we may sort it when necessary
-	p.all = append(p.all, txs...)
+	return txs
+}
+
+// add inserts the txs unknown to the pool and not evicted recently, and returns their number,
+// the caller must hold the write lock
+func (p *TxfPool) add(source string, txs []*PoolTx) (added int) {
+	baseFee := p.baseFee.Load()
+	var batch []*PoolTx
 	for _, tx := range txs {
+		// the same tx may be fed by several nodes, and by both the snapshot and the new tx feed
+		known, ok := p.m[tx.Hash]
+		if !ok {
+			known, ok = p.superseded[tx.Hash]
+		}
+		if ok {
+			known.sources[source] = true
+			// the delay is only meaningful between the announcements of the tx
+			if _, ok := known.Delays[source]; !ok && tx.FirstSeenBy != "" && known.FirstSeenBy != "" {
+				known.Delays[source] = tx.FirstSeen - known.FirstSeen
+			}
+			continue
+		}
+		if expiry, ok := p.evicted[tx.Hash]; ok && expiry > tx.FirstSeen {
+			// remembered as long as a node still offers it, or it would come back as a fresh tx
+			p.evicted[tx.Hash] = max(expiry, tx.FirstSeen+evictedTTL.Milliseconds())
+			continue
+		}
+		p.seq++
+		tx.seq = p.seq
+		tx.EffectiveTip = effectiveTip(tx, baseFee)
+		tx.EffectiveGasPrice = effectiveGasPrice(tx, baseFee)
+		p.replace(tx)
+		p.all = append(p.all, tx)
 		p.m[tx.Hash] = tx
+		p.bytes += tx.Raw.Size()
+		p.index(tx)
+		batch = append(batch, tx)
 	}
+	// the sorted indexes are merged at once, without the txs replaced by later ones of the batch
+	indexed := slices.DeleteFunc(slices.Clone(batch), func(tx *PoolTx) bool { return tx.SupersededBy != nil })
+	for _, index := range p.indexes {
+		index.insert(indexed)
+	}
+	return len(batch)
 }
 
-func (p *TxfPool) Block(hashes []common.Hash) {
+// remove deletes txs by hash and returns the number of txs removed, the superseded ones are kept
+// in their replacement chains, and the chains of the others are forgotten.
+// The caller must hold the write lock.
+func (p *TxfPool) remove(hashes []common.Hash) int {
 	toRm := make(map[common.Hash]bool, len(hashes))
-	p.lock.Lock()
-	defer p.lock.Unlock()
 	for _, hash := range hashes {
-		toRm[hash] = true
-		delete(p.m, hash)
+		if tx, ok := p.m[hash]; ok {
+			toRm[hash] = true
+			p.unindex(tx)
+			delete(p.m, hash)
+			if tx.SupersededBy != nil {
+				// still counted in bytes until forgotten or evicted
+				p.superseded[hash] = tx
+			} else {
+				p.bytes -= tx.Raw.Size()
+				p.forget(*tx.From, tx.Nonce)
+			}
+		}
+	}
+	if len(toRm) == 0 {
+		return 0
+	}
+	for _, index := range p.indexes {
+		index.remove(toRm)
 	}
 	lenPool := len(p.all)
 	offset := 0
@@ -112,7 +301,118 @@ func (p *TxfPool) Block(hashes []common.Hash) {
 		}
 	}
 	p.all = p.all[:len(p.all)-offset]
-	slog.Info("new block rm transactions from pool", "size", lenPool, "removed", offset, "remain", len(p.all))
+	return offset
+}
+
+// Block removes the txs mined by a new block, their senders' on-chain nonces are raised past them
+func (p *TxfPool) Block(hashes []common.Hash) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	lenPool := len(p.all)
+	nonces := make(map[common.Address]uint64)
+	for _, hash := range hashes {
+		tx, ok := p.m[hash]
+		if !ok {
+			// a replaced tx may still be mined instead of its replacement
+			tx, ok = p.superseded[hash]
+		}
+		if ok && tx.Nonce+1 > nonces[*tx.From] {
+			nonces[*tx.From] = tx.Nonce + 1
+		}
+	}
+	removed := p.remove(hashes)
+	var stale []common.Hash
+	for addr, nonce := range nonces {
+		if s, ok := p.senders[addr]; !ok || !s.known || s.nonce < nonce {
+			stale = append(stale, p.setNonce(addr, nonce)...)
+		}
+	}
+	removed += p.remove(stale)
+	slog.Info("new block rm transactions from pool", "size", lenPool, "removed", removed, "remain", len(p.all))
+}
+
+// Drop removes txs which left the txpool of source. The txs mined or whose nonce is spent
+// are removed, the others, e.g. evicted or replaced, only left source and are removed once
+// no node holds them. The replaced ones are superseded in case their replacement isn't fed yet.
+func (p *TxfPool) Drop(source string, dropped []mps.DroppedTx) {
+	hashes := make([]common.Hash, 0, len(dropped))
+	reasons := make(map[mps.DropReason]int)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	lenPool := len(p.all)
+	removed := 0
+	for _, d := range dropped {
+		reasons[d.Reason]++
+		tx, ok := p.m[d.Hash]
+		if !ok {
+			continue
+		}
+		if d.Reason != mps.DropReasonMined && d.Reason != mps.DropReasonInvalidated {
+			delete(tx.sources, source)
+			if len(tx.sources) > 0 {
+				continue
+			}
+		}
+		if d.Reason == mps.DropReasonReplaced && d.ReplacedBy != nil {
+			p.supersede(tx, *d.ReplacedBy)
+			removed++
+			continue
+		}
+		hashes = append(hashes, d.Hash)
+	}
+	removed += p.remove(hashes)
+	slog.Info("dropped transactions from pool", "size", lenPool, "removed", removed, "remain", len(p.all), "reasons", reasons)
+}
+
+// Reorg restores the txs un-mined by a chain reorg, and removes the ones mined by the new chain
+func (p *TxfPool) Reorg(source string, e *mps.ReorgEvent) {
+	// the reinjected txs were announced before they were mined, not by the reorg
+	p.Backfill(source, &e.Reinjected)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	// the on-chain nonces of the senders of reinjected txs went back
+	for _, tx := range e.Reinjected.Txs {
+		if tx, ok := p.m[tx.Hash()]; ok {
+			if s := p.senders[*tx.From]; s.known && s.nonce > tx.Nonce {
+				p.setNonce(*tx.From, tx.Nonce)
+			}
+		}
+	}
+	removed := p.remove(e.Included)
+	slog.Info("chain reorg", "depth", e.Depth, "reinjected", len(e.Reinjected.Txs), "removed", removed, "remain", len(p.all))
+}
+
+// Reconcile makes the pool match content, the whole txpool of the node source fetched at fetchedAt.
+// backed are the sources whose txpool is the one of source, e.g. the MPS of the same node.
+// The txs missing from the pool are added without attribution, and the ones missing from content
+// no longer count source nor backed as holders. The ones held by no other node are removed, unless
+// they were seen after fetchedAt as content may predate them, while the ones held by other nodes
+// are left to their drops.
+func (p *TxfPool) Reconcile(source string, backed []string, content *mps.TxsWithSender, fetchedAt time.Time) (added, removed int) {
+	txs := newPoolTxs(source, content, time.Now().UnixMilli(), false)
+	held := make(map[common.Hash]bool, len(txs))
+	for _, tx := range txs {
+		held[tx.Hash] = true
+	}
+	checked := p.checkSenders(source, txs)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var stale []common.Hash
+	for _, tx := range p.all {
+		if held[tx.Hash] || tx.FirstSeen >= fetchedAt.UnixMilli() {
+			continue
+		}
+		delete(tx.sources, source)
+		for _, b := range backed {
+			delete(tx.sources, b)
+		}
+		if len(tx.sources) == 0 {
+			stale = append(stale, tx.Hash)
+		}
+	}
+	removed = p.remove(stale)
+	added = p.add(source, checked)
+	return added, removed
 }
 
 func pageInfo(page, pageSize, total int) (start, end int) {
@@ -131,20 +431,24 @@ func pageInfo(page, pageSize, total int) (start, end int) {
 	return start, end
 }
 
-func (p *TxfPool) All(page, pageSize int) (selected []*PoolTx, total int) {
-	total = len(p.all)
+// All returns a page of the txs in order, selected from the sorted index of its key
+func (p *TxfPool) All(page, pageSize int, order Order) (selected []*PoolTx, total int) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	index, ok := p.indexes[order.By]
+	if !ok {
+		index = p.indexes[SortArrival]
+	}
+	total = len(index.txs)
 	start, end := pageInfo(page, pageSize, total)
-	if start == end {
-		return make([]*PoolTx, 0), total
+	selected = make([]*PoolTx, 0, end-start)
+	for i := start; i < end; i++ {
+		j := i
+		if order.Desc {
+			j = total - 1 - i
+		}
+		selected = append(selected, index.txs[j].clone())
 	}
-	p.lock.RLock()
-	selected = make([]*PoolTx, end-start)
-	// respond latest transactions first
-	// the order of transactions is assumed to be in the order of timestamp,
-	// so we simply selected from tail to head and reverse it
-	copy(selected, p.all[total-end:total-start])
-	p.lock.RUnlock()
-	slices.Reverse(selected)
 	return selected, total
 }
 
@@ -152,5 +456,26 @@ func (p *TxfPool) Get(hash common.Hash) (*PoolTx, bool) {
 	p.lock.RLock()
 	defer p.lock.RUnlock()
 	tx, ok := p.m[hash]
-	return tx, ok
+	if !ok {
+		if tx, ok = p.superseded[hash]; !ok {
+			return nil, false
+		}
+	}
+	return tx.clone(), true
+}
+
+// SetBaseFee updates the effective tips and gas prices at baseFee, and sorts their indexes again
+func (p *TxfPool) SetBaseFee(baseFee *big.Int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if old := p.baseFee.Load(); old != nil && baseFee != nil && old.Cmp(baseFee) == 0 {
+		return
+	}
+	p.baseFee.Store(baseFee)
+	for _, tx := range p.all {
+		tx.EffectiveTip = effectiveTip(tx, baseFee)
+		tx.EffectiveGasPrice = effectiveGasPrice(tx, baseFee)
+	}
+	p.indexes[SortTip].resort()
+	p.indexes[SortGasPrice].resort()
 }
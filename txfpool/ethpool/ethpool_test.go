@@ -2,7 +2,15 @@ package ethpool
 
 import (
 	"fmt"
+	"math/big"
 	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/holiman/uint256"
+
+	"github.com/moodbase/TxForesight/mps"
 )
 
 func TestPageInfo(t *testing.T) {
@@ -31,13 +39,11 @@ func TestPageInfo(t *testing.T) {
 }
 
 func TestTxfETHPool_All(t *testing.T) {
-	p := NewTxfPool()
-	p.all = []*PoolTx{
-		{Nonce: 1},
-		{Nonce: 2},
-		{Nonce: 3},
-		{Nonce: 4},
-		{Nonce: 5},
+	p := NewTxfPool(Config{})
+	from := common.Address{0x02}
+	for nonce := uint64(1); nonce <= 5; nonce++ {
+		tx := types.NewTransaction(nonce, common.Address{0x01}, big.NewInt(1), 21000, big.NewInt(1), nil)
+		p.Feed("mps", &mps.TxsWithSender{Txs: types.Transactions{tx}, Senders: []*common.Address{&from}})
 	}
 	pages := []struct {
 		page     int
@@ -50,8 +56,160 @@ func TestTxfETHPool_All(t *testing.T) {
 		{3, 2},
 	}
 	for _, page := range pages {
-		selected, total := p.All(page.page, page.pageSize)
+		selected, total := p.All(page.page, page.pageSize, Order{By: SortArrival, Desc: true})
 		fmt.Println(page.page, page.pageSize)
 		fmt.Println(selected, total)
 	}
 }
+
+func TestTxfPoolFeedSources(t *testing.T) {
+	p := NewTxfPool(Config{})
+	tx := types.NewTransaction(0, common.Address{0x01}, big.NewInt(1), 21000, big.NewInt(1), nil)
+	from := common.Address{0x02}
+	txs := &mps.TxsWithSender{Txs: types.Transactions{tx}, Senders: []*common.Address{&from}}
+
+	p.Feed("eu", txs)
+	time.Sleep(10 * time.Millisecond)
+	p.Feed("us", txs)
+	p.Feed("eu", txs)
+
+	got, ok := p.Get(tx.Hash())
+	if !ok {
+		t.Fatal("tx not found")
+	}
+	if _, total := p.All(1, 10, Order{By: SortArrival, Desc: true}); total != 1 {
+		t.Errorf("total = %d, want 1", total)
+	}
+	if got.FirstSeenBy != "eu" || got.FirstSeen == 0 {
+		t.Errorf("first seen by %s at %d, want eu", got.FirstSeenBy, got.FirstSeen)
+	}
+	if len(got.Delays) != 2 || got.Delays["eu"] != 0 || got.Delays["us"] < 10 {
+		t.Errorf("delays = %v, want eu 0 and us >= 10", got.Delays)
+	}
+	// the txs returned are copies
+	got.Delays["ap"] = 1
+	if again, _ := p.Get(tx.Hash()); len(again.Delays) != 2 {
+		t.Error("pool tx modified through Get")
+	}
+}
+
+func TestTxfPoolBackfill(t *testing.T) {
+	p := NewTxfPool(Config{})
+	from := common.Address{0x02}
+	txs := make([]*types.Transaction, 2)
+	for i := range txs {
+		txs[i] = types.NewTransaction(uint64(i), common.Address{0x01}, big.NewInt(1), 21000, big.NewInt(1), nil)
+	}
+	// tx 0 is backfilled before being announced, tx 1 is announced before being backfilled
+	p.Backfill("eu", &mps.TxsWithSender{Txs: txs[:1], Senders: []*common.Address{&from}})
+	p.Feed("us", &mps.TxsWithSender{Txs: txs, Senders: []*common.Address{&from, &from}})
+	p.Backfill("eu", &mps.TxsWithSender{Txs: txs[1:], Senders: []*common.Address{&from}})
+
+	if tx, _ := p.Get(txs[0].Hash()); tx.FirstSeenBy != "" || len(tx.Delays) != 0 {
+		t.Errorf("backfilled tx first seen by %q with delays %v, want none", tx.FirstSeenBy, tx.Delays)
+	}
+	if tx, _ := p.Get(txs[1].Hash()); tx.FirstSeenBy != "us" || len(tx.Delays) != 1 {
+		t.Errorf("announced tx first seen by %q with delays %v, want us only", tx.FirstSeenBy, tx.Delays)
+	}
+}
+
+func TestTxfPoolDropSources(t *testing.T) {
+	p := NewTxfPool(Config{})
+	from := common.Address{0x02}
+	txs := make([]*types.Transaction, 2)
+	for i := range txs {
+		txs[i] = types.NewTransaction(uint64(i), common.Address{0x01}, big.NewInt(1), 21000, big.NewInt(1), nil)
+	}
+	feed := &mps.TxsWithSender{Txs: txs, Senders: []*common.Address{&from, &from}}
+	p.Feed("eu", feed)
+	p.Backfill("us", feed)
+
+	// an eviction is local to the node, the tx is removed once no node holds it
+	p.Drop("eu", []mps.DroppedTx{{Hash: txs[0].Hash(), Reason: mps.DropReasonEvicted}})
+	if _, ok := p.Get(txs[0].Hash()); !ok {
+		t.Error("tx held by us removed")
+	}
+	p.Drop("us", []mps.DroppedTx{{Hash: txs[0].Hash(), Reason: mps.DropReasonEvicted}})
+	if _, ok := p.Get(txs[0].Hash()); ok {
+		t.Error("tx held by no node kept")
+	}
+	// a mined tx is removed whoever holds it
+	p.Drop("eu", []mps.DroppedTx{{Hash: txs[1].Hash(), Reason: mps.DropReasonMined}})
+	if _, ok := p.Get(txs[1].Hash()); ok {
+		t.Error("mined tx kept")
+	}
+}
+
+func TestTxfPoolReconcile(t *testing.T) {
+	p := NewTxfPool(Config{})
+	from := common.Address{0x02}
+	txs := make([]*types.Transaction, 3)
+	for i := range txs {
+		txs[i] = types.NewTransaction(uint64(i), common.Address{0x01}, big.NewInt(1), 21000, big.NewInt(1), nil)
+	}
+	// the pool holds txs 0 and 1 from the mps of the rpc node, the rpc node holds txs 1 and 2,
+	// and tx 1 is also held by another node
+	p.Feed("mps", &mps.TxsWithSender{Txs: txs[:2], Senders: []*common.Address{&from, &from}})
+	p.Feed("other", &mps.TxsWithSender{Txs: txs[1:2], Senders: []*common.Address{&from}})
+	backed := []string{"mps"}
+	added, removed := p.Reconcile("rpc", backed, &mps.TxsWithSender{Txs: txs[1:], Senders: []*common.Address{&from, &from}}, time.Now().Add(time.Second))
+	if added != 1 || removed != 1 {
+		t.Errorf("added %d removed %d, want 1 and 1", added, removed)
+	}
+	// tx 0 was only held by the mps of the rpc node, which missed its drop
+	if _, ok := p.Get(txs[0].Hash()); ok {
+		t.Error("tx missing from the rpc node kept")
+	}
+	// the content isn't an announcement, so the missing tx isn't attributed to the rpc node
+	if tx, ok := p.Get(txs[2].Hash()); !ok || tx.FirstSeenBy != "" || len(tx.Delays) != 0 {
+		t.Errorf("missing tx not added unattributed: %+v", tx)
+	}
+
+	// txs seen after the content was fetched are kept
+	if _, removed := p.Reconcile("rpc", backed, &mps.TxsWithSender{}, time.Now().Add(-time.Second)); removed != 0 {
+		t.Errorf("removed %d, want 0", removed)
+	}
+	// the txs held by the rpc node are removed once it no longer holds them, unless another node does
+	if _, removed := p.Reconcile("rpc", backed, &mps.TxsWithSender{}, time.Now().Add(time.Second)); removed != 1 {
+		t.Errorf("removed %d, want 1", removed)
+	}
+	if _, ok := p.Get(txs[2].Hash()); ok {
+		t.Error("stale tx kept")
+	}
+	if _, total := p.All(1, 10, Order{}); total != 1 {
+		t.Errorf("total = %d, want the tx held by the other node", total)
+	}
+}
+
+func TestTxfPoolFeeFields(t *testing.T) {
+	p := NewTxfPool(Config{})
+	from := common.Address{0x02}
+	to := common.Address{0x01}
+	accessList := types.AccessList{{Address: to, StorageKeys: []common.Hash{{0x01}, {0x02}}}}
+	dynamic := types.NewTx(&types.DynamicFeeTx{Nonce: 0, GasTipCap: big.NewInt(2), GasFeeCap: big.NewInt(10), Gas: 21000, To: &to, AccessList: accessList})
+	blob := types.NewTx(&types.BlobTx{Nonce: 1, GasTipCap: uint256.NewInt(3), GasFeeCap: uint256.NewInt(12), Gas: 21000, To: to, BlobFeeCap: uint256.NewInt(7), BlobHashes: []common.Hash{{0x01}, {0x02}}})
+	legacy := types.NewTransaction(2, to, big.NewInt(1), 21000, big.NewInt(9), nil)
+	p.Feed("mps", &mps.TxsWithSender{Txs: types.Transactions{dynamic, blob, legacy}, Senders: []*common.Address{&from, &from, &from}})
+
+	got, _ := p.Get(dynamic.Hash())
+	if got.Type != types.DynamicFeeTxType || got.GasTipCap.Int64() != 2 || got.GasFeeCap.Int64() != 10 || got.AccessListSize != 1 || got.AccessListKeys != 2 {
+		t.Errorf("dynamic fee tx fields: %+v", got)
+	}
+	if got.EffectiveTip != nil {
+		t.Errorf("effective tip %v without base fee, want nil", got.EffectiveTip)
+	}
+	if got, _ := p.Get(blob.Hash()); got.Type != types.BlobTxType || got.BlobFeeCap.Int64() != 7 || got.BlobHashes != 2 {
+		t.Errorf("blob tx fields: %+v", got)
+	}
+
+	p.SetBaseFee(big.NewInt(9))
+	for tx, want := range map[*types.Transaction]int64{dynamic: 1, blob: 3, legacy: 0} {
+		if got, _ := p.Get(tx.Hash()); got.EffectiveTip.Int64() != want {
+			t.Errorf("tx type %d effective tip = %v, want %d", tx.Type(), got.EffectiveTip, want)
+		}
+	}
+	p.SetBaseFee(big.NewInt(11))
+	if got, _ := p.Get(dynamic.Hash()); got.EffectiveTip.Sign() >= 0 {
+		t.Errorf("effective tip = %v below base fee, want negative", got.EffectiveTip)
+	}
+}
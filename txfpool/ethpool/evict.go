@@ -0,0 +1,171 @@
+package ethpool
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// EvictPolicy chooses the txs evicted when the pool is over capacity
+type EvictPolicy int
+
+const (
+	// EvictOldest evicts the txs seen first
+	EvictOldest EvictPolicy = iota
+	// EvictLowestFee evicts the txs with the lowest fee cap, the lowest tip cap between equal fee caps
+	EvictLowestFee
+)
+
+func (e EvictPolicy) String() string {
+	switch e {
+	case EvictOldest:
+		return "oldest"
+	case EvictLowestFee:
+		return "lowestFee"
+	default:
+		return "unknown"
+	}
+}
+
+// evictInterval is the interval of the evictions run by TxfPool.Run
+const evictInterval = 5 * time.Second
+
+// evictedTTL is how long an evicted tx isn't added back since it was last offered, longer than
+// the reconciliation interval
+const evictedTTL = 30 * time.Minute
+
+// Stats are the size and the eviction counters of the pool,
+// Bytes is the encoded size of the txs along with the superseded ones
+type Stats struct {
+	Txs        int    `json:"txs"`
+	Bytes      uint64 `json:"bytes"`
+	Superseded int    `json:"superseded"`
+	// EvictedByAge are the txs older than MaxAge, EvictedByCapacity the txs over MaxTxs or MaxBytes
+	EvictedByAge      uint64 `json:"evictedByAge"`
+	EvictedByCapacity uint64 `json:"evictedByCapacity"`
+}
+
+// Stats returns the size and the eviction counters of the pool
+func (p *TxfPool) Stats() Stats {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return Stats{
+		Txs:               len(p.all),
+		Bytes:             p.bytes,
+		Superseded:        len(p.superseded),
+		EvictedByAge:      p.evictedByAge.Load(),
+		EvictedByCapacity: p.evictedByCapacity.Load(),
+	}
+}
+
+// Run evicts the txs over the limits of the pool in the background until ctx is done,
+// nothing is ever evicted without limits. The replacement chains given up are forgotten meanwhile.
+func (p *TxfPool) Run(ctx context.Context) {
+	ticker := time.NewTicker(evictInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.evict(time.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// evict removes the txs older than MaxAge at now, and then the txs over MaxTxs or MaxBytes
+// chosen by the EvictPolicy. The superseded txs count toward MaxAge and MaxBytes, and are
+// evicted first when over MaxBytes. The evicted txs are remembered for evictedTTL.
+func (p *TxfPool) evict(now time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for hash, expiry := range p.evicted {
+		if expiry <= now.UnixMilli() {
+			delete(p.evicted, hash)
+		}
+	}
+	lenPool := len(p.all)
+	var byAge int
+	if p.cfg.MaxAge > 0 {
+		expiry := now.Add(-p.cfg.MaxAge).UnixMilli()
+		var expired []common.Hash
+		for _, tx := range p.all {
+			if tx.FirstSeen < expiry {
+				expired = append(expired, tx.Hash)
+			}
+		}
+		for hash, tx := range p.superseded {
+			if tx.FirstSeen < expiry && p.dropSuperseded(hash) {
+				p.remember(now, hash)
+				byAge++
+			}
+		}
+		p.remember(now, expired...)
+		byAge += p.remove(expired)
+		p.evictedByAge.Add(uint64(byAge))
+	}
+	var byCapacity int
+	if p.cfg.MaxBytes > 0 && p.bytes > p.cfg.MaxBytes && len(p.superseded) > 0 {
+		superseded := make([]*PoolTx, 0, len(p.superseded))
+		for _, tx := range p.superseded {
+			superseded = append(superseded, tx)
+		}
+		slices.SortFunc(superseded, byArrival)
+		for _, tx := range superseded {
+			if p.bytes <= p.cfg.MaxBytes {
+				break
+			}
+			p.dropSuperseded(tx.Hash)
+			p.remember(now, tx.Hash)
+			byCapacity++
+		}
+	}
+	if p.overCapacity() {
+		victims := p.indexes[SortArrival].txs
+		if p.cfg.EvictPolicy == EvictLowestFee {
+			victims = slices.Clone(victims)
+			slices.SortStableFunc(victims, func(a, b *PoolTx) int {
+				if c := a.Raw.GasFeeCapCmp(b.Raw); c != 0 {
+					return c
+				}
+				return a.Raw.GasTipCapCmp(b.Raw)
+			})
+		}
+		var evicted []common.Hash
+		txs, bytes := len(p.all), p.bytes
+		for _, tx := range victims {
+			if (p.cfg.MaxTxs <= 0 || txs <= p.cfg.MaxTxs) && (p.cfg.MaxBytes == 0 || bytes <= p.cfg.MaxBytes) {
+				break
+			}
+			evicted = append(evicted, tx.Hash)
+			txs--
+			bytes -= tx.Raw.Size()
+		}
+		p.remember(now, evicted...)
+		byCapacity += p.remove(evicted)
+	}
+	p.evictedByCapacity.Add(uint64(byCapacity))
+	pruned := p.pruneChains(now)
+	if byAge > 0 || byCapacity > 0 || pruned > 0 {
+		slog.Info("evicted transactions from pool", "size", lenPool, "byAge", byAge, "byCapacity", byCapacity,
+			"remain", len(p.all), "bytes", p.bytes, "prunedChains", pruned)
+	}
+}
+
+// remember keeps the evicted hashes from being added back for evictedTTL after now,
+// the caller must hold the write lock
+func (p *TxfPool) remember(now time.Time, hashes ...common.Hash) {
+	expiry := now.Add(evictedTTL).UnixMilli()
+	for _, hash := range hashes {
+		p.evicted[hash] = expiry
+	}
+}
+
+// overCapacity reports whether the pool holds more than MaxTxs or MaxBytes,
+// the caller must hold the lock
+func (p *TxfPool) overCapacity() bool {
+	return (p.cfg.MaxTxs > 0 && len(p.all) > p.cfg.MaxTxs) || (p.cfg.MaxBytes > 0 && p.bytes > p.cfg.MaxBytes)
+}
@@ -0,0 +1,143 @@
+package ethpool
+
+import (
+	"math/big"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/moodbase/TxForesight/mps"
+)
+
+func TestTxfPoolEvict(t *testing.T) {
+	from := common.Address{0x02}
+	txs := make(types.Transactions, 4)
+	senders := make([]*common.Address, len(txs))
+	for i, price := range []int64{30, 10, 40, 20} {
+		txs[i] = types.NewTransaction(uint64(i), common.Address{0x01}, big.NewInt(1), 21000, big.NewInt(price), nil)
+		senders[i] = &from
+	}
+	feed := func(p *TxfPool) {
+		// one tx per millisecond, so that they are seen in order
+		for i := range txs {
+			p.Feed("mps", &mps.TxsWithSender{Txs: txs[i : i+1], Senders: senders[i : i+1]})
+			time.Sleep(time.Millisecond)
+		}
+	}
+	held := func(p *TxfPool) (nonces []uint64) {
+		all, _ := p.All(1, 10, Order{By: SortArrival, Desc: true})
+		for _, tx := range all {
+			nonces = append(nonces, tx.Nonce)
+		}
+		return nonces
+	}
+
+	tests := []struct {
+		name  string
+		cfg   Config
+		held  []uint64 // latest first
+		stats Stats
+	}{
+		{"no limit", Config{}, []uint64{3, 2, 1, 0}, Stats{Txs: 4}},
+		{"oldest", Config{MaxTxs: 2}, []uint64{3, 2}, Stats{Txs: 2, EvictedByCapacity: 2}},
+		{"lowest fee", Config{MaxTxs: 2, EvictPolicy: EvictLowestFee}, []uint64{2, 0}, Stats{Txs: 2, EvictedByCapacity: 2}},
+		{"bytes", Config{MaxBytes: 3 * txs[0].Size()}, []uint64{3, 2, 1}, Stats{Txs: 3, EvictedByCapacity: 1}},
+		{"age", Config{MaxAge: time.Hour, MaxTxs: 1}, []uint64{3}, Stats{Txs: 1, EvictedByAge: 2, EvictedByCapacity: 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := NewTxfPool(test.cfg)
+			feed(p)
+			now := time.Now()
+			if test.cfg.MaxAge > 0 {
+				// the first two txs are expired
+				now = time.UnixMilli(p.m[txs[2].Hash()].FirstSeen).Add(test.cfg.MaxAge)
+			}
+			p.evict(now)
+			if got := held(p); !slices.Equal(got, test.held) {
+				t.Errorf("held nonces %v, want %v", got, test.held)
+			}
+			stats := p.Stats()
+			test.stats.Bytes = uint64(len(test.held)) * txs[0].Size()
+			if stats != test.stats {
+				t.Errorf("stats = %+v, want %+v", stats, test.stats)
+			}
+			// the evicted txs aren't added back, e.g. by the next snapshot
+			feed(p)
+			if got := held(p); !slices.Equal(got, test.held) {
+				t.Errorf("held nonces after feeding again %v, want %v", got, test.held)
+			}
+		})
+	}
+}
+
+func TestTxfPoolEvictSuperseded(t *testing.T) {
+	from := common.Address{0x02}
+	original := types.NewTransaction(0, common.Address{0x01}, big.NewInt(1), 21000, big.NewInt(10), nil)
+	speedUp := types.NewTransaction(0, common.Address{0x01}, big.NewInt(1), 21000, big.NewInt(12), nil)
+	next := types.NewTransaction(1, common.Address{0x01}, big.NewInt(1), 21000, big.NewInt(10), nil)
+	feed := func(p *TxfPool) {
+		for _, tx := range []*types.Transaction{original, speedUp, next} {
+			p.Feed("mps", &mps.TxsWithSender{Txs: types.Transactions{tx}, Senders: []*common.Address{&from}})
+			time.Sleep(time.Millisecond)
+		}
+	}
+	size := original.Size()
+
+	tests := []struct {
+		name string
+		cfg  Config
+		now  func(p *TxfPool) time.Time
+	}{
+		{"bytes", Config{MaxBytes: 2 * size}, func(p *TxfPool) time.Time { return time.Now() }},
+		// only the original is older than MaxAge
+		{"age", Config{MaxAge: time.Hour}, func(p *TxfPool) time.Time {
+			return time.UnixMilli(p.m[speedUp.Hash()].FirstSeen).Add(time.Hour)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := NewTxfPool(test.cfg)
+			feed(p)
+			if stats := p.Stats(); stats.Bytes != 3*size || stats.Superseded != 1 {
+				t.Fatalf("stats = %+v, want the superseded tx counted", stats)
+			}
+			p.evict(test.now(p))
+			// the superseded tx goes first, the live ones are kept
+			stats := p.Stats()
+			if stats.Txs != 2 || stats.Superseded != 0 || stats.Bytes != 2*size || stats.EvictedByAge+stats.EvictedByCapacity != 1 {
+				t.Errorf("stats = %+v, want 2 live txs and the superseded one evicted", stats)
+			}
+			if chain, ok := p.Replacements(speedUp.Hash()); !ok || len(chain) != 2 {
+				t.Errorf("chain = %v, want it kept along with the speed up", chain)
+			}
+		})
+	}
+}
+
+func TestTxfPoolEvictedOffered(t *testing.T) {
+	from := common.Address{0x02}
+	old := types.NewTransaction(0, common.Address{0x01}, big.NewInt(1), 21000, big.NewInt(10), nil)
+	p := NewTxfPool(Config{MaxAge: time.Hour})
+	offer := func() {
+		p.Feed("mps", &mps.TxsWithSender{Txs: types.Transactions{old}, Senders: []*common.Address{&from}})
+	}
+	offer()
+	p.evict(time.Now().Add(2 * time.Hour))
+	if _, ok := p.Get(old.Hash()); ok {
+		t.Fatal("the old tx isn't evicted")
+	}
+
+	// evictedTTL later, a node still offers the tx which is remembered again
+	p.evicted[old.Hash()] = time.Now().UnixMilli() + 5
+	offer()
+	time.Sleep(10 * time.Millisecond)
+	p.evict(time.Now())
+	offer()
+	if _, ok := p.Get(old.Hash()); ok {
+		t.Error("the evicted tx is added back while it's still offered")
+	}
+}
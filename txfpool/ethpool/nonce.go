@@ -0,0 +1,198 @@
+package ethpool
+
+import (
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// TxStatus classifies a tx against the on-chain nonce of its sender
+type TxStatus string
+
+const (
+	TxStatusUnknown TxStatus = ""        // the on-chain nonce of the sender is not resolved yet
+	TxStatusPending TxStatus = "pending" // executable, its nonce follows the on-chain nonce without gap
+	TxStatusQueued  TxStatus = "queued"  // not executable until the nonce gap before it is filled
+)
+
+// senderTxs are the txs of one sender ordered by nonce
+type senderTxs struct {
+	nonce   uint64    // on-chain nonce, the nonce of the next tx to be mined
+	known   bool      // whether nonce is resolved
+	updated time.Time // when nonce was last resolved or raised
+	txs     []*PoolTx
+}
+
+// insert keeps txs ordered by nonce, a tx goes after the ones with the same nonce
+func (s *senderTxs) insert(tx *PoolTx) {
+	i := sort.Search(len(s.txs), func(i int) bool { return s.txs[i].Nonce > tx.Nonce })
+	s.txs = append(s.txs, nil)
+	copy(s.txs[i+1:], s.txs[i:])
+	s.txs[i] = tx
+}
+
+func (s *senderTxs) delete(tx *PoolTx) {
+	i := sort.Search(len(s.txs), func(i int) bool { return s.txs[i].Nonce >= tx.Nonce })
+	for ; i < len(s.txs) && s.txs[i].Nonce == tx.Nonce; i++ {
+		if s.txs[i] == tx {
+			s.txs = append(s.txs[:i], s.txs[i+1:]...)
+			return
+		}
+	}
+}
+
+// stale returns the txs whose nonce is below the on-chain nonce, which can't be mined anymore
+func (s *senderTxs) stale() []common.Hash {
+	if !s.known {
+		return nil
+	}
+	var hashes []common.Hash
+	for _, tx := range s.txs {
+		if tx.Nonce >= s.nonce {
+			break
+		}
+		hashes = append(hashes, tx.Hash)
+	}
+	return hashes
+}
+
+// hasPending reports whether any tx of the sender is pending
+func (s *senderTxs) hasPending() bool {
+	for _, tx := range s.txs {
+		if tx.Status == TxStatusPending {
+			return true
+		}
+	}
+	return false
+}
+
+// classify sets the status of the txs, the ones with nonces following the on-chain nonce
+// without gap are pending, the others are queued
+func (s *senderTxs) classify() {
+	next := s.nonce
+	for _, tx := range s.txs {
+		switch {
+		case !s.known:
+			tx.Status = TxStatusUnknown
+		case tx.Nonce == next:
+			tx.Status = TxStatusPending
+			next++
+		case tx.Nonce < next:
+			// another tx with the same nonce, or a stale one about to be removed
+			tx.Status = TxStatusPending
+		default:
+			tx.Status = TxStatusQueued
+		}
+	}
+}
+
+// index adds tx to the nonce index of its sender, the caller must hold the write lock
+func (p *TxfPool) index(tx *PoolTx) {
+	s, ok := p.senders[*tx.From]
+	if !ok {
+		s = new(senderTxs)
+		p.senders[*tx.From] = s
+	}
+	s.insert(tx)
+	s.classify()
+}
+
+// unindex removes tx from the nonce index of its sender, the caller must hold the write lock
+func (p *TxfPool) unindex(tx *PoolTx) {
+	s, ok := p.senders[*tx.From]
+	if !ok {
+		return
+	}
+	s.delete(tx)
+	if len(s.txs) == 0 {
+		delete(p.senders, *tx.From)
+		return
+	}
+	s.classify()
+}
+
+// setNonce sets the on-chain nonce of addr, and returns the txs it made stale,
+// the caller must hold the write lock
+func (p *TxfPool) setNonce(addr common.Address, nonce uint64) []common.Hash {
+	p.forgetBelow(addr, nonce)
+	s, ok := p.senders[addr]
+	if !ok {
+		return nil
+	}
+	s.nonce, s.known, s.updated = nonce, true, time.Now()
+	s.classify()
+	return s.stale()
+}
+
+// SetNonces sets the on-chain nonces of senders, removing their txs with lower nonces.
+// A known nonce is only raised, as the nonces may be resolved from a node lagging behind
+// the blocks already seen, see Reorg for the nonces going back.
+func (p *TxfPool) SetNonces(nonces map[common.Address]uint64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var stale []common.Hash
+	for addr, nonce := range nonces {
+		if s, ok := p.senders[addr]; ok && s.known && s.nonce >= nonce {
+			s.updated = time.Now()
+			continue
+		}
+		stale = append(stale, p.setNonce(addr, nonce)...)
+	}
+	p.remove(stale)
+}
+
+// UnresolvedSenders returns up to limit senders whose on-chain nonce is unknown, and then
+// the senders without pending tx whose nonce wasn't updated for maxAge, as their nonce may
+// have been raised by txs the pool never saw
+func (p *TxfPool) UnresolvedSenders(limit int, maxAge time.Duration) []common.Address {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	var addrs, outdated []common.Address
+	for addr, s := range p.senders {
+		if len(addrs) == limit {
+			break
+		}
+		if !s.known {
+			addrs = append(addrs, addr)
+		} else if len(outdated) < limit && time.Since(s.updated) >= maxAge && !s.hasPending() {
+			outdated = append(outdated, addr)
+		}
+	}
+	return append(addrs, outdated[:min(len(outdated), limit-len(addrs))]...)
+}
+
+// Pending returns the executable txs, latest first
+func (p *TxfPool) Pending(page, pageSize int) (selected []*PoolTx, total int) {
+	return p.selectByStatus(TxStatusPending, page, pageSize)
+}
+
+// Queued returns the txs behind a nonce gap, latest first
+func (p *TxfPool) Queued(page, pageSize int) (selected []*PoolTx, total int) {
+	return p.selectByStatus(TxStatusQueued, page, pageSize)
+}
+
+func (p *TxfPool) selectByStatus(status TxStatus, page, pageSize int) (selected []*PoolTx, total int) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	arrival := p.indexes[SortArrival].txs
+	for _, tx := range arrival {
+		if tx.Status == status {
+			total++
+		}
+	}
+	start, end := pageInfo(page, pageSize, total)
+	selected = make([]*PoolTx, 0, end-start)
+	n := 0
+	for i := len(arrival) - 1; i >= 0 && n < end; i-- {
+		tx := arrival[i]
+		if tx.Status != status {
+			continue
+		}
+		if n >= start {
+			selected = append(selected, tx.clone())
+		}
+		n++
+	}
+	return selected, total
+}
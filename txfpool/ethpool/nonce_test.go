@@ -0,0 +1,113 @@
+package ethpool
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/moodbase/TxForesight/mps"
+)
+
+func TestTxfPoolNonceClassify(t *testing.T) {
+	p := NewTxfPool(Config{})
+	from := common.Address{0x02}
+	txs := make(types.Transactions, 5)
+	senders := make([]*common.Address, len(txs))
+	for i := range txs {
+		txs[i] = types.NewTransaction(uint64(i), common.Address{0x01}, big.NewInt(1), 21000, big.NewInt(1), nil)
+		senders[i] = &from
+	}
+	// nonces 0, 1, 3 and 4 are held, 2 is missing
+	p.Feed("mps", &mps.TxsWithSender{Txs: types.Transactions{txs[0], txs[1], txs[3], txs[4]}, Senders: senders[:4]})
+	status := func(i int) TxStatus {
+		tx, ok := p.Get(txs[i].Hash())
+		if !ok {
+			return "removed"
+		}
+		return tx.Status
+	}
+	if got := p.UnresolvedSenders(10, time.Hour); len(got) != 1 || got[0] != from {
+		t.Fatalf("unresolved senders = %v, want %v", got, from)
+	}
+	if s := status(0); s != TxStatusUnknown {
+		t.Errorf("status before nonce resolution = %q, want unknown", s)
+	}
+
+	p.SetNonces(map[common.Address]uint64{from: 0})
+	if len(p.UnresolvedSenders(10, time.Hour)) != 0 {
+		t.Error("sender still unresolved")
+	}
+	// a lagging node doesn't bring a known nonce back
+	p.SetNonces(map[common.Address]uint64{from: 0})
+	for i, want := range map[int]TxStatus{0: TxStatusPending, 1: TxStatusPending, 3: TxStatusQueued, 4: TxStatusQueued} {
+		if s := status(i); s != want {
+			t.Errorf("tx %d status = %q, want %q", i, s, want)
+		}
+	}
+	if _, total := p.Pending(1, 10); total != 2 {
+		t.Errorf("pending total = %d, want 2", total)
+	}
+	if queued, total := p.Queued(1, 10); total != 2 || queued[0].Nonce != 4 {
+		t.Errorf("queued total = %d, want 2 latest first", total)
+	}
+
+	// filling the gap makes the queued txs pending
+	p.Feed("mps", &mps.TxsWithSender{Txs: txs[2:3], Senders: senders[2:3]})
+	if s := status(4); s != TxStatusPending {
+		t.Errorf("tx 4 status after gap filled = %q, want pending", s)
+	}
+
+	// mining tx 1 removes tx 0 too, as its nonce is spent
+	p.Block([]common.Hash{txs[1].Hash()})
+	if s := status(0); s != "removed" {
+		t.Errorf("stale tx 0 status = %q, want removed", s)
+	}
+	if _, total := p.Pending(1, 10); total != 3 {
+		t.Errorf("pending total after block = %d, want 3", total)
+	}
+
+	// a reorg un-mining tx 1 brings the nonce back
+	p.Reorg("mps", &mps.ReorgEvent{Reinjected: mps.TxsWithSender{Txs: txs[1:2], Senders: senders[1:2]}})
+	if s := status(1); s != TxStatusPending {
+		t.Errorf("reinjected tx status = %q, want pending", s)
+	}
+	if _, total := p.Pending(1, 10); total != 4 {
+		t.Errorf("pending total after reorg = %d, want 4", total)
+	}
+}
+
+func TestTxfPoolSetNoncesRaiseOnly(t *testing.T) {
+	p := NewTxfPool(Config{})
+	from := common.Address{0x02}
+	txs := types.Transactions{
+		types.NewTransaction(1, common.Address{0x01}, big.NewInt(1), 21000, big.NewInt(1), nil),
+		types.NewTransaction(3, common.Address{0x01}, big.NewInt(1), 21000, big.NewInt(1), nil),
+	}
+	p.Feed("mps", &mps.TxsWithSender{Txs: txs, Senders: []*common.Address{&from, &from}})
+	p.SetNonces(map[common.Address]uint64{from: 1})
+	// a lagging node resolves a lower nonce, which is ignored
+	p.SetNonces(map[common.Address]uint64{from: 0})
+	if tx, _ := p.Get(txs[0].Hash()); tx.Status != TxStatusPending {
+		t.Errorf("status = %q, want pending", tx.Status)
+	}
+	// a sender with pending txs is kept up to date by the blocks
+	if got := p.UnresolvedSenders(10, 0); len(got) != 0 {
+		t.Errorf("outdated senders = %v, want none", got)
+	}
+
+	// the nonce raised by txs never seen leaves only queued txs, which are resolved again
+	p.SetNonces(map[common.Address]uint64{from: 2})
+	if got := p.UnresolvedSenders(10, time.Hour); len(got) != 0 {
+		t.Errorf("outdated senders = %v, want none before max age", got)
+	}
+	if got := p.UnresolvedSenders(10, 0); len(got) != 1 || got[0] != from {
+		t.Errorf("outdated senders = %v, want %v", got, from)
+	}
+	p.SetNonces(map[common.Address]uint64{from: 3})
+	if tx, _ := p.Get(txs[1].Hash()); tx.Status != TxStatusPending {
+		t.Errorf("status = %q, want pending", tx.Status)
+	}
+}
@@ -0,0 +1,169 @@
+package ethpool
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// replacementTimeout is how long a tx superseded by a drop waits for a live tx
+// with the same sender and nonce, e.g. its replacement, before its chain is forgotten
+const replacementTimeout = 5 * time.Minute
+
+// Replacement is a tx of a replacement chain, the txs of a sender with the same nonce,
+// e.g. sped up or cancelled, in the order they were seen
+type Replacement struct {
+	Hash        common.Hash `json:"hash"`
+	GasTipCap   *big.Int    `json:"gasTipCap"`
+	GasFeeCap   *big.Int    `json:"gasFeeCap"`
+	FirstSeenBy string      `json:"firstSeenBy"`
+	FirstSeen   int64       `json:"firstSeen"`
+	// TipDelta and FeeCapDelta are the bumps from the previous tx of the chain, nil for the original
+	TipDelta    *big.Int `json:"tipDelta,omitempty"`
+	FeeCapDelta *big.Int `json:"feeCapDelta,omitempty"`
+}
+
+// replacementChain is the replacement history of a sender and nonce, the original first
+type replacementChain []*Replacement
+
+// append adds tx to the chain with its bumps from the last tx
+func (c replacementChain) append(tx *PoolTx) replacementChain {
+	r := &Replacement{
+		Hash:        tx.Hash,
+		GasTipCap:   tx.Raw.GasTipCap(),
+		GasFeeCap:   tx.Raw.GasFeeCap(),
+		FirstSeenBy: tx.FirstSeenBy,
+		FirstSeen:   tx.FirstSeen,
+	}
+	if len(c) > 0 {
+		last := c[len(c)-1]
+		r.TipDelta = new(big.Int).Sub(r.GasTipCap, last.GasTipCap)
+		r.FeeCapDelta = new(big.Int).Sub(r.GasFeeCap, last.GasFeeCap)
+	}
+	return append(c, r)
+}
+
+// replace supersedes the txs of the same sender and nonce as tx, which is about to be added,
+// and records tx in their replacement chain. The caller must hold the write lock.
+func (p *TxfPool) replace(tx *PoolTx) {
+	var replaced []common.Hash
+	if s, ok := p.senders[*tx.From]; ok {
+		for _, old := range s.txs {
+			if old.Nonce == tx.Nonce {
+				replaced = append(replaced, old.Hash)
+			}
+		}
+	}
+	for _, hash := range replaced {
+		p.supersede(p.m[hash], tx.Hash)
+	}
+	if chain, ok := p.chains[*tx.From][tx.Nonce]; ok {
+		p.chains[*tx.From][tx.Nonce] = chain.append(tx)
+	}
+}
+
+// supersede marks tx as replaced by hash, and moves it out of the live txs into its replacement chain.
+// The caller must hold the write lock.
+func (p *TxfPool) supersede(tx *PoolTx, by common.Hash) {
+	chains, ok := p.chains[*tx.From]
+	if !ok {
+		chains = make(map[uint64]replacementChain)
+		p.chains[*tx.From] = chains
+	}
+	if _, ok := chains[tx.Nonce]; !ok {
+		chains[tx.Nonce] = replacementChain{}.append(tx)
+	}
+	tx.SupersededBy = &by
+	tx.supersededAt = time.Now().UnixMilli()
+	p.remove([]common.Hash{tx.Hash})
+}
+
+// live reports whether the pool holds a tx of addr and nonce which isn't superseded,
+// the caller must hold the lock
+func (p *TxfPool) live(addr common.Address, nonce uint64) bool {
+	if s, ok := p.senders[addr]; ok {
+		for _, tx := range s.txs {
+			if tx.Nonce == nonce {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pruneChains forgets the replacement chains without live tx, whose last tx was superseded
+// before now minus replacementTimeout, as their replacement may never be fed, e.g. rejected
+// by the sender check. It returns the number of chains forgotten, the caller must hold the write lock.
+func (p *TxfPool) pruneChains(now time.Time) (pruned int) {
+	expiry := now.Add(-replacementTimeout).UnixMilli()
+	for addr, chains := range p.chains {
+		for nonce, chain := range chains {
+			if p.live(addr, nonce) {
+				continue
+			}
+			if last, ok := p.superseded[chain[len(chain)-1].Hash]; ok && last.supersededAt >= expiry {
+				continue
+			}
+			p.forget(addr, nonce)
+			pruned++
+		}
+	}
+	return pruned
+}
+
+// forget deletes the replacement chain of addr and nonce, along with its superseded txs,
+// once the nonce is mined or given up. The caller must hold the write lock.
+func (p *TxfPool) forget(addr common.Address, nonce uint64) {
+	chain, ok := p.chains[addr][nonce]
+	if !ok {
+		return
+	}
+	for _, r := range chain {
+		p.dropSuperseded(r.Hash)
+	}
+	delete(p.chains[addr], nonce)
+	if len(p.chains[addr]) == 0 {
+		delete(p.chains, addr)
+	}
+}
+
+// dropSuperseded deletes the superseded tx of hash if any, its replacement chain is kept.
+// The caller must hold the write lock.
+func (p *TxfPool) dropSuperseded(hash common.Hash) bool {
+	tx, ok := p.superseded[hash]
+	if ok {
+		delete(p.superseded, hash)
+		p.bytes -= tx.Raw.Size()
+	}
+	return ok
+}
+
+// forgetBelow forgets the replacement chains of addr with nonces below nonce, which are spent.
+// The caller must hold the write lock.
+func (p *TxfPool) forgetBelow(addr common.Address, nonce uint64) {
+	for n := range p.chains[addr] {
+		if n < nonce {
+			p.forget(addr, n)
+		}
+	}
+}
+
+// Replacements returns the replacement chain of the tx of hash, the original first.
+// The chain is empty if the tx replaced nothing and wasn't replaced.
+func (p *TxfPool) Replacements(hash common.Hash) ([]Replacement, bool) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	tx, ok := p.m[hash]
+	if !ok {
+		if tx, ok = p.superseded[hash]; !ok {
+			return nil, false
+		}
+	}
+	chain := p.chains[*tx.From][tx.Nonce]
+	replacements := make([]Replacement, len(chain))
+	for i, r := range chain {
+		replacements[i] = *r
+	}
+	return replacements, true
+}
@@ -0,0 +1,92 @@
+package ethpool
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/moodbase/TxForesight/mps"
+)
+
+func TestTxfPoolReplacements(t *testing.T) {
+	p := NewTxfPool(Config{})
+	from := common.Address{0x02}
+	feed := func(tx *types.Transaction) {
+		p.Feed("mps", &mps.TxsWithSender{Txs: types.Transactions{tx}, Senders: []*common.Address{&from}})
+	}
+	original := types.NewTransaction(0, common.Address{0x01}, big.NewInt(1), 21000, big.NewInt(10), nil)
+	speedUp := types.NewTransaction(0, common.Address{0x01}, big.NewInt(1), 21000, big.NewInt(12), nil)
+	cancel := types.NewTransaction(0, from, big.NewInt(0), 21000, big.NewInt(15), nil)
+	next := types.NewTransaction(1, common.Address{0x01}, big.NewInt(1), 21000, big.NewInt(10), nil)
+	feed(original)
+	feed(next)
+	feed(speedUp)
+	// the replaced tx is announced dropped before its replacement
+	p.Drop("mps", []mps.DroppedTx{{Hash: speedUp.Hash(), Reason: mps.DropReasonReplaced, ReplacedBy: ptr(cancel.Hash())}})
+	feed(cancel)
+	// a replaced tx fed again isn't added back
+	feed(original)
+
+	if _, total := p.All(1, 10, Order{By: SortArrival, Desc: true}); total != 2 {
+		t.Errorf("total = %d, want the cancel and the next tx", total)
+	}
+	if tx, ok := p.Get(original.Hash()); !ok || tx.SupersededBy == nil || *tx.SupersededBy != speedUp.Hash() {
+		t.Errorf("original not superseded by the speed up: %v", tx)
+	}
+	chain, ok := p.Replacements(speedUp.Hash())
+	if !ok || len(chain) != 3 {
+		t.Fatalf("chain = %v, want 3 txs", chain)
+	}
+	for i, want := range []common.Hash{original.Hash(), speedUp.Hash(), cancel.Hash()} {
+		if chain[i].Hash != want {
+			t.Errorf("chain[%d] = %v, want %v", i, chain[i].Hash, want)
+		}
+	}
+	if chain[0].TipDelta != nil || chain[1].TipDelta.Int64() != 2 || chain[2].FeeCapDelta.Int64() != 3 {
+		t.Errorf("deltas = %v %v %v, want nil 2 3", chain[0].TipDelta, chain[1].TipDelta, chain[2].FeeCapDelta)
+	}
+	if chain, ok := p.Replacements(next.Hash()); !ok || len(chain) != 0 {
+		t.Errorf("chain of an unreplaced tx = %v, want empty", chain)
+	}
+
+	// mining the nonce forgets the chain
+	p.Block([]common.Hash{cancel.Hash()})
+	if _, ok := p.Replacements(original.Hash()); ok {
+		t.Error("chain kept after the nonce is mined")
+	}
+	if len(p.superseded) != 0 || len(p.chains) != 0 {
+		t.Errorf("%d superseded and %d chains left", len(p.superseded), len(p.chains))
+	}
+}
+
+func TestTxfPoolPruneChains(t *testing.T) {
+	p := NewTxfPool(Config{})
+	from := common.Address{0x02}
+	original := types.NewTransaction(0, common.Address{0x01}, big.NewInt(1), 21000, big.NewInt(10), nil)
+	speedUp := types.NewTransaction(0, common.Address{0x01}, big.NewInt(1), 21000, big.NewInt(12), nil)
+	replaced := types.NewTransaction(1, common.Address{0x01}, big.NewInt(1), 21000, big.NewInt(10), nil)
+	p.Feed("mps", &mps.TxsWithSender{Txs: types.Transactions{original, speedUp, replaced}, Senders: []*common.Address{&from, &from, &from}})
+	// the replacement of nonce 1 is never fed
+	p.Drop("mps", []mps.DroppedTx{{Hash: replaced.Hash(), Reason: mps.DropReasonReplaced, ReplacedBy: ptr(common.Hash{0x01})}})
+
+	if pruned := p.pruneChains(time.Now()); pruned != 0 {
+		t.Errorf("pruned %d chains before the timeout, want 0", pruned)
+	}
+	// the chain of nonce 0 is kept along with its live speed up
+	if pruned := p.pruneChains(time.Now().Add(replacementTimeout + time.Second)); pruned != 1 {
+		t.Errorf("pruned %d chains, want 1", pruned)
+	}
+	if _, ok := p.Get(replaced.Hash()); ok {
+		t.Error("tx superseded by a replacement never fed kept")
+	}
+	if chain, ok := p.Replacements(original.Hash()); !ok || len(chain) != 2 {
+		t.Errorf("chain = %v, want the original and the speed up", chain)
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,121 @@
+package ethpool
+
+import (
+	"log/slog"
+	"runtime"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// SenderCheck controls how the senders announced with the txs are checked,
+// senders are only recovered once a signer is set, see TxfPool.SetSigner
+type SenderCheck int
+
+const (
+	// SenderTrust trusts the announced senders, only the missing ones are recovered
+	SenderTrust SenderCheck = iota
+	// SenderFlag recovers every sender, a tx whose announced sender doesn't match
+	// is kept with the recovered one and flagged
+	SenderFlag
+	// SenderReject recovers every sender, and rejects the txs whose announced sender doesn't match
+	SenderReject
+)
+
+func (c SenderCheck) String() string {
+	switch c {
+	case SenderTrust:
+		return "trust"
+	case SenderFlag:
+		return "flag"
+	case SenderReject:
+		return "reject"
+	default:
+		return "unknown"
+	}
+}
+
+// minParallelRecovery is the number of txs below which senders are recovered sequentially
+const minParallelRecovery = 16
+
+// recoverSenders recovers the sender of every tx, in parallel across the cores,
+// the sender of a tx with an invalid signature is nil
+func recoverSenders(signer types.Signer, txs []*PoolTx) []*common.Address {
+	senders := make([]*common.Address, len(txs))
+	recoverRange := func(start, end int) {
+		for i := start; i < end; i++ {
+			if from, err := types.Sender(signer, txs[i].Raw); err == nil {
+				senders[i] = &from
+			}
+		}
+	}
+	workers := runtime.NumCPU()
+	if len(txs) < minParallelRecovery || workers == 1 {
+		recoverRange(0, len(txs))
+		return senders
+	}
+	var wg sync.WaitGroup
+	size := (len(txs) + workers - 1) / workers
+	for start := 0; start < len(txs); start += size {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recoverRange(start, min(start+size, len(txs)))
+		}()
+	}
+	wg.Wait()
+	return senders
+}
+
+// checkSenders checks the senders of txs according to the SenderCheck of the pool,
+// and returns the txs to add. The txs whose sender is unknown are never added.
+func (p *TxfPool) checkSenders(source string, txs []*PoolTx) []*PoolTx {
+	signer, _ := p.signer.Load().(types.Signer)
+	var toRecover []*PoolTx
+	for _, tx := range txs {
+		if signer != nil && (tx.From == nil || p.cfg.SenderCheck != SenderTrust) {
+			toRecover = append(toRecover, tx)
+		}
+	}
+	recovered := make(map[*PoolTx]*common.Address, len(toRecover))
+	if len(toRecover) > 0 {
+		for i, from := range recoverSenders(signer, toRecover) {
+			recovered[toRecover[i]] = from
+		}
+	}
+	var unknown, mismatched int
+	checked := txs[:0]
+	for _, tx := range txs {
+		from, ok := recovered[tx]
+		switch {
+		case !ok:
+		case from == nil:
+			// invalid signature
+			tx.From = nil
+		case tx.From == nil:
+			tx.From = from
+		case *tx.From != *from:
+			mismatched++
+			if p.cfg.SenderCheck == SenderReject {
+				continue
+			}
+			tx.ClaimedFrom, tx.From = tx.From, from
+			tx.SenderMismatch = true
+		}
+		if tx.From == nil {
+			unknown++
+			continue
+		}
+		checked = append(checked, tx)
+	}
+	if unknown > 0 || mismatched > 0 {
+		slog.Warn("txs with wrong senders", "source", source, "unknown", unknown, "mismatched", mismatched, "check", p.cfg.SenderCheck)
+	}
+	return checked
+}
+
+// SetSigner sets the signer of the chain, which recovers the senders
+func (p *TxfPool) SetSigner(signer types.Signer) {
+	p.signer.Store(signer)
+}
@@ -0,0 +1,75 @@
+package ethpool
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+
+	"github.com/moodbase/TxForesight/mps"
+)
+
+func TestTxfPoolSenderCheck(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	signer := types.LatestSigner(params.TestChainConfig)
+	txs := make(types.Transactions, 3)
+	for i := range txs {
+		txs[i] = types.MustSignNewTx(key, signer, &types.LegacyTx{Nonce: uint64(i), To: &common.Address{}, Gas: 21000, GasPrice: big.NewInt(1)})
+	}
+	liar := common.Address{0x0b}
+	// a right, a missing and a wrong sender
+	senders := []*common.Address{&from, nil, &liar}
+
+	tests := []struct {
+		check    SenderCheck
+		signer   bool
+		kept     int
+		flagged  bool // whether the tx with the wrong sender is kept and flagged
+		recovers bool // whether the missing sender is recovered
+	}{
+		{SenderTrust, false, 2, false, false},
+		{SenderTrust, true, 3, false, true},
+		{SenderFlag, true, 3, true, true},
+		{SenderReject, true, 2, false, true},
+	}
+	for i, test := range tests {
+		p := NewTxfPool(Config{SenderCheck: test.check})
+		if test.signer {
+			p.SetSigner(signer)
+		}
+		p.Feed("mps", &mps.TxsWithSender{Txs: txs, Senders: senders})
+		if _, total := p.All(1, 10, Order{By: SortArrival, Desc: true}); total != test.kept {
+			t.Errorf("test %d: kept %d txs, want %d", i, total, test.kept)
+		}
+		if tx, ok := p.Get(txs[1].Hash()); ok != test.recovers || ok && *tx.From != from {
+			t.Errorf("test %d: missing sender recovered %v, want %v", i, ok, test.recovers)
+		}
+		tx, ok := p.Get(txs[2].Hash())
+		if test.flagged {
+			if !ok || !tx.SenderMismatch || *tx.From != from || *tx.ClaimedFrom != liar {
+				t.Errorf("test %d: wrong sender not flagged: %+v", i, tx)
+			}
+		} else if ok && tx.SenderMismatch {
+			t.Errorf("test %d: wrong sender flagged", i)
+		}
+	}
+}
+
+func TestRecoverSendersParallel(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	signer := types.LatestSigner(params.TestChainConfig)
+	txs := make([]*PoolTx, 3*minParallelRecovery+1)
+	for i := range txs {
+		txs[i] = &PoolTx{Raw: types.MustSignNewTx(key, signer, &types.LegacyTx{Nonce: uint64(i), Gas: 21000, GasPrice: big.NewInt(1)})}
+	}
+	for i, sender := range recoverSenders(signer, txs) {
+		if sender == nil || *sender != from {
+			t.Fatalf("tx %d: sender = %v, want %v", i, sender, from)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package ethpool
+
+import (
+	"cmp"
+	"fmt"
+	"math/big"
+	"slices"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+)
+
+// SortKey is a key the txs of the pool are indexed by
+type SortKey string
+
+const (
+	SortArrival  SortKey = "arrival"  // FirstSeen
+	SortGasPrice SortKey = "gasPrice" // EffectiveGasPrice
+	SortTip      SortKey = "tip"      // EffectiveTip, GasTipCap while the base fee is unknown
+	SortValue    SortKey = "value"
+	SortGas      SortKey = "gas" // gas limit
+)
+
+// Order is the order of the txs returned by TxfPool.All, the default is the latest first
+type Order struct {
+	By   SortKey
+	Desc bool
+}
+
+// ParseOrder parses the sort key and the order, asc or desc, which default to arrival and desc
+func ParseOrder(by, order string) (Order, error) {
+	o := Order{By: SortKey(by), Desc: true}
+	if o.By == "" {
+		o.By = SortArrival
+	}
+	if _, ok := sortKeys[o.By]; !ok {
+		return o, fmt.Errorf("unknown sort key %q", by)
+	}
+	switch order {
+	case "", "desc":
+	case "asc":
+		o.Desc = false
+	default:
+		return o, fmt.Errorf("unknown order %q", order)
+	}
+	return o, nil
+}
+
+// byArrival orders txs by FirstSeen, and then by their order of addition so that the order is total
+func byArrival(a, b *PoolTx) int {
+	if c := cmp.Compare(a.FirstSeen, b.FirstSeen); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.seq, b.seq)
+}
+
+// byBig orders txs by the big int key, and then by arrival
+func byBig(key func(*PoolTx) *big.Int) func(a, b *PoolTx) int {
+	return func(a, b *PoolTx) int {
+		if c := key(a).Cmp(key(b)); c != 0 {
+			return c
+		}
+		return byArrival(a, b)
+	}
+}
+
+var sortKeys = map[SortKey]func(a, b *PoolTx) int{
+	SortArrival:  byArrival,
+	SortGasPrice: byBig(func(tx *PoolTx) *big.Int { return tx.EffectiveGasPrice }),
+	SortTip: byBig(func(tx *PoolTx) *big.Int {
+		if tx.EffectiveTip == nil {
+			return tx.GasTipCap
+		}
+		return tx.EffectiveTip
+	}),
+	SortValue: byBig(func(tx *PoolTx) *big.Int { return tx.Value }),
+	SortGas: func(a, b *PoolTx) int {
+		if c := cmp.Compare(a.Gas, b.Gas); c != 0 {
+			return c
+		}
+		return byArrival(a, b)
+	},
+}
+
+// sortedIndex holds the txs of the pool in ascending order, it's updated by batches
+// so that a feed of many txs is merged at once
+type sortedIndex struct {
+	cmp func(a, b *PoolTx) int
+	txs []*PoolTx
+}
+
+func newSortedIndexes() map[SortKey]*sortedIndex {
+	indexes := make(map[SortKey]*sortedIndex, len(sortKeys))
+	for key, cmp := range sortKeys {
+		indexes[key] = &sortedIndex{cmp: cmp}
+	}
+	return indexes
+}
+
+// insert merges txs into the index
+func (x *sortedIndex) insert(txs []*PoolTx) {
+	if len(txs) == 0 {
+		return
+	}
+	added := slices.Clone(txs)
+	slices.SortFunc(added, x.cmp)
+	merged := make([]*PoolTx, 0, len(x.txs)+len(added))
+	i, j := 0, 0
+	for i < len(x.txs) && j < len(added) {
+		if x.cmp(x.txs[i], added[j]) <= 0 {
+			merged = append(merged, x.txs[i])
+			i++
+		} else {
+			merged = append(merged, added[j])
+			j++
+		}
+	}
+	merged = append(merged, x.txs[i:]...)
+	x.txs = append(merged, added[j:]...)
+}
+
+// remove deletes the txs of toRm from the index
+func (x *sortedIndex) remove(toRm map[common.Hash]bool) {
+	x.txs = slices.DeleteFunc(x.txs, func(tx *PoolTx) bool { return toRm[tx.Hash] })
+}
+
+// resort sorts the index again after its keys changed
+func (x *sortedIndex) resort() {
+	slices.SortFunc(x.txs, x.cmp)
+}
+
+// effectiveTip is the tip paid by tx at baseFee, negative if its fee cap is below it,
+// nil while the base fee is unknown
+func effectiveTip(tx *PoolTx, baseFee *big.Int) *big.Int {
+	if baseFee == nil {
+		return nil
+	}
+	return math.BigMin(tx.GasTipCap, new(big.Int).Sub(tx.GasFeeCap, baseFee))
+}
+
+// effectiveGasPrice is the gas price paid by tx at baseFee, its fee cap while the base fee is unknown
+func effectiveGasPrice(tx *PoolTx, baseFee *big.Int) *big.Int {
+	if baseFee == nil {
+		return tx.GasFeeCap
+	}
+	return math.BigMin(tx.GasFeeCap, new(big.Int).Add(baseFee, tx.GasTipCap))
+}
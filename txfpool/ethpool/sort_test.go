@@ -0,0 +1,89 @@
+package ethpool
+
+import (
+	"math/big"
+	"slices"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+
+	"github.com/moodbase/TxForesight/mps"
+)
+
+func TestTxfPoolSort(t *testing.T) {
+	p := NewTxfPool(Config{})
+	to := common.Address{0x01}
+	// tx i is sent by sender i, in order
+	txs := []*types.Transaction{
+		types.NewTx(&types.DynamicFeeTx{GasTipCap: big.NewInt(1), GasFeeCap: big.NewInt(30), Gas: 30000, To: &to, Value: big.NewInt(3)}),
+		types.NewTx(&types.DynamicFeeTx{GasTipCap: big.NewInt(5), GasFeeCap: big.NewInt(12), Gas: 21000, To: &to, Value: big.NewInt(1)}),
+		types.NewTransaction(0, to, big.NewInt(2), 50000, big.NewInt(20), nil),
+	}
+	for i, tx := range txs {
+		from := common.Address{byte(i + 1)}
+		p.Feed("mps", &mps.TxsWithSender{Txs: types.Transactions{tx}, Senders: []*common.Address{&from}})
+	}
+	order := func(by SortKey, desc bool) (indexes []int) {
+		selected, _ := p.All(1, 10, Order{By: by, Desc: desc})
+		for _, tx := range selected {
+			indexes = append(indexes, slices.IndexFunc(txs, func(t *types.Transaction) bool { return t.Hash() == tx.Hash }))
+		}
+		return indexes
+	}
+	tests := []struct {
+		by   SortKey
+		desc bool
+		want []int
+	}{
+		{SortArrival, true, []int{2, 1, 0}},
+		{SortArrival, false, []int{0, 1, 2}},
+		{SortGasPrice, false, []int{1, 2, 0}}, // fee caps without base fee
+		{SortTip, true, []int{2, 1, 0}},
+		{SortValue, false, []int{1, 2, 0}},
+		{SortGas, true, []int{2, 0, 1}},
+	}
+	for _, test := range tests {
+		if got := order(test.by, test.desc); !slices.Equal(got, test.want) {
+			t.Errorf("%s desc=%v: %v, want %v", test.by, test.desc, got, test.want)
+		}
+	}
+
+	// at base fee 10 the gas prices are 11, 12 and 20
+	p.SetBaseFee(big.NewInt(10))
+	if got := order(SortGasPrice, false); !slices.Equal(got, []int{0, 1, 2}) {
+		t.Errorf("gas price order at base fee: %v, want [0 1 2]", got)
+	}
+	// the tip of the legacy tx is what's left of its gas price above the base fee,
+	// at base fee 25 the tips are 1, -13 and -5
+	p.SetBaseFee(big.NewInt(25))
+	if got := order(SortTip, true); !slices.Equal(got, []int{0, 2, 1}) {
+		t.Errorf("tip order at base fee: %v, want [0 2 1]", got)
+	}
+
+	// the indexes follow the removals
+	p.Block([]common.Hash{txs[1].Hash()})
+	if got := order(SortValue, false); !slices.Equal(got, []int{2, 0}) {
+		t.Errorf("value order after block: %v, want [2 0]", got)
+	}
+}
+
+func TestParseOrder(t *testing.T) {
+	tests := []struct {
+		by, order string
+		want      Order
+		ok        bool
+	}{
+		{"", "", Order{By: SortArrival, Desc: true}, true},
+		{"gasPrice", "asc", Order{By: SortGasPrice}, true},
+		{"value", "desc", Order{By: SortValue, Desc: true}, true},
+		{"nonce", "", Order{}, false},
+		{"gas", "up", Order{}, false},
+	}
+	for _, test := range tests {
+		got, err := ParseOrder(test.by, test.order)
+		if (err == nil) != test.ok || (test.ok && got != test.want) {
+			t.Errorf("ParseOrder(%q, %q) = %v, %v", test.by, test.order, got, err)
+		}
+	}
+}